@@ -0,0 +1,194 @@
+// Package archive converts directory trees to and from tar streams, so that a whole
+// directory can be stored as a single entry. Relative paths, permissions and
+// modification times are kept; ownership is not.
+package archive
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Pack writes the directory tree rooted at root to w as a tar stream.
+func Pack(w io.Writer, root string) error {
+	tw := tar.NewWriter(w)
+
+	err := filepath.Walk(root, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Paths are stored relative to the root, which itself is not stored.
+		rel, err := filepath.Rel(root, name)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+
+		var link string
+		switch mode := info.Mode(); {
+		case mode.IsRegular(), mode.IsDir():
+		case mode&os.ModeSymlink != 0:
+			if link, err = os.Readlink(name); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("! Cannot archive %s: not a regular file, directory or symbolic link", name)
+		}
+
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+
+		// Don't record who owns the files.
+		hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = 0, 0, "", ""
+		hdr.Format = tar.FormatPAX
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		// Copy the contents of the file.
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// Unpack recreates the tree read from the tar stream r at dest, which must not
+// already exist. Entries that would end up outside of dest are rejected.
+func Unpack(r io.Reader, dest string) error {
+	if err := os.Mkdir(dest, 0700); err != nil {
+		return err
+	}
+
+	// Directories get their final permissions and times once everything inside
+	// them has been written.
+	var dirs []*tar.Header
+
+	// Symbolic links we have created, which must not be followed.
+	links := make(map[string]bool)
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		name, err := cleanName(hdr.Name, links)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, filepath.FromSlash(name))
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return err
+			}
+			dirs = append(dirs, hdr)
+		case tar.TypeReg, tar.TypeRegA:
+			if err := writeFile(target, tr, hdr); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+			links[name] = true
+		default:
+			return fmt.Errorf("! Cannot extract %s: unsupported type", hdr.Name)
+		}
+	}
+
+	// Apply the directories' attributes, deepest first.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		name, _ := cleanName(dirs[i].Name, nil)
+		target := filepath.Join(dest, filepath.FromSlash(name))
+
+		// A directory entry may share its name with an earlier symbolic link, which
+		// Chmod and Chtimes would follow.
+		info, err := os.Lstat(target)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("! Refusing to extract %s: not a directory", dirs[i].Name)
+		}
+		if err := os.Chmod(target, os.FileMode(dirs[i].Mode).Perm()); err != nil {
+			return err
+		}
+		if err := os.Chtimes(target, time.Now(), dirs[i].ModTime); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeFile creates a regular file from a tar entry.
+func writeFile(target string, r io.Reader, hdr *tar.Header) error {
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.Chmod(target, os.FileMode(hdr.Mode).Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(target, time.Now(), hdr.ModTime)
+}
+
+// cleanName checks that a name from a tar header stays inside the destination and
+// does not pass through any of the given symbolic links, and returns it cleaned.
+func cleanName(name string, links map[string]bool) (string, error) {
+	cleaned := path.Clean(strings.TrimSuffix(name, "/"))
+	if path.IsAbs(cleaned) || cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("! Refusing to extract %s: outside of destination", name)
+	}
+
+	for dir := path.Dir(cleaned); dir != "."; dir = path.Dir(dir) {
+		if links[dir] {
+			return "", fmt.Errorf("! Refusing to extract %s: inside a symbolic link", name)
+		}
+	}
+
+	return cleaned, nil
+}
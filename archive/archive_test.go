@@ -0,0 +1,99 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPackUnpack(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	// Build a small tree.
+	src := filepath.Join(tmp, "src")
+	os.MkdirAll(filepath.Join(src, "a", "b"), 0700)
+	os.Mkdir(filepath.Join(src, "empty"), 0750)
+	ioutil.WriteFile(filepath.Join(src, "top"), []byte("top level"), 0600)
+	ioutil.WriteFile(filepath.Join(src, "a", "b", "deep"), []byte("deep down"), 0640)
+	if err := os.Symlink("a/b/deep", filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := Pack(&buf, src); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	dest := filepath.Join(tmp, "dest")
+	if err := Unpack(&buf, dest); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	for name, contents := range map[string]string{"top": "top level", "a/b/deep": "deep down", "link": "deep down"} {
+		b, err := ioutil.ReadFile(filepath.Join(dest, filepath.FromSlash(name)))
+		if err != nil || string(b) != contents {
+			t.Error("Unexpected contents for", name, string(b), err)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(dest, "a", "b", "deep")); err != nil || info.Mode().Perm() != 0640 {
+		t.Error("Expected mode to be kept;", info.Mode(), err)
+	}
+	if info, err := os.Stat(filepath.Join(dest, "empty")); err != nil || !info.IsDir() || info.Mode().Perm() != 0750 {
+		t.Error("Expected empty directory to be kept;", err)
+	}
+
+	// The destination must not already exist.
+	if err := Unpack(bytes.NewReader(nil), dest); !os.IsExist(err) {
+		t.Error("Expected existing destination to be rejected; got", err)
+	}
+}
+
+func TestUnpackTraversal(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	victim := filepath.Join(tmp, "victim")
+	if err := os.Mkdir(victim, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, headers := range [][]*tar.Header{
+		{{Name: "../escape", Typeflag: tar.TypeReg, Mode: 0600}},
+		{{Name: "/abs", Typeflag: tar.TypeReg, Mode: 0600}},
+		{
+			{Name: "link", Typeflag: tar.TypeSymlink, Linkname: ".."},
+			{Name: "link/escape", Typeflag: tar.TypeReg, Mode: 0600},
+		},
+		{
+			{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "../victim"},
+			{Name: "link/", Typeflag: tar.TypeDir, Mode: 0777, ModTime: time.Unix(0, 0)},
+		},
+	} {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, hdr := range headers {
+			tw.WriteHeader(hdr)
+		}
+		tw.Close()
+
+		if err := Unpack(&buf, filepath.Join(tmp, string('a'+rune(i)))); err == nil {
+			t.Error("Expected error for case", i)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "escape")); !os.IsNotExist(err) {
+		t.Error("Archive escaped its destination")
+	}
+	if info, err := os.Stat(victim); err != nil || info.Mode().Perm() != 0700 || info.ModTime().Equal(time.Unix(0, 0)) {
+		t.Error("Archive changed a directory outside its destination:", info.Mode(), info.ModTime(), err)
+	}
+}
@@ -1,73 +1,79 @@
 package coffer
 
 import (
-	"os"
+	"errors"
+	"fmt"
 	"os/user"
-
-	"github.com/syndtr/goleveldb/leveldb"
+	"path/filepath"
 )
 
-var (
-	// Coffer is a pointer to the database object.
-	Coffer *leveldb.DB
-)
+// ErrStorage is returned, wrapped around the underlying cause, when the storage
+// engine fails to carry out an operation.
+var ErrStorage = errors.New("! Storage error")
 
-// Setup sets up the environment.
-func Setup() error {
-	// Ascertain the path to the secret store.
-	user, err := user.Current()
-	if err != nil {
-		return err
-	}
+// Store holds identifier : ciphertext pairs. Identifiers and ciphertexts are
+// opaque byte slices; a store never sees any plaintext.
+type Store interface {
+	// Exists checks if an entry exists and returns true or false.
+	Exists(identifier []byte) (bool, error)
 
-	// Check if we've done this before.
-	if _, err = os.Stat(user.HomeDir + "/.dissident"); err != nil {
-		// Apparently we haven't.
+	// Save saves a secret.
+	Save(identifier, ciphertext []byte) error
 
-		// Create a directory to store our stuff in.
-		err = os.Mkdir(user.HomeDir+"/.dissident", 0700)
-		if err != nil {
-			return err
-		}
-	}
+	// Retrieve retrieves a secret, returning nil if it does not exist.
+	Retrieve(identifier []byte) ([]byte, error)
 
-	// Open the database file.
-	Coffer, err = leveldb.OpenFile(user.HomeDir+"/.dissident/coffer", nil)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	// Delete deletes an entry. Deleting an entry that does not exist is not an error.
+	Delete(identifier []byte) error
 }
 
-// Exists checks if an entry exists and returns true or false.
-func Exists(identifier []byte) bool {
-	_, err := Coffer.Get(identifier, nil)
-	if err != nil {
-		return false
-	}
+// Backend is implemented by anything that is able to store a coffer.
+type Backend interface {
+	Store
 
-	return true
-}
+	// Begin starts a transaction. Only one transaction may be open at a time, and
+	// the backend should not be written to directly until it is finished.
+	Begin() (Transaction, error)
+
+	// Walk calls fn with everything stored, in no particular order, stopping at the
+	// first error fn returns. fn may save or delete values, but those may or may not be
+	// walked over.
+	Walk(fn func(identifier, ciphertext []byte) error) error
 
-// Save saves a secret to the database.
-func Save(identifier, ciphertext []byte) {
-	Coffer.Put(identifier, ciphertext, nil)
+	// Close releases any resources held by the backend. Any open transaction is
+	// discarded.
+	Close() error
 }
 
-// Retrieve retrieves a secret from the database.
-func Retrieve(identifier []byte) []byte {
-	data, _ := Coffer.Get(identifier, nil)
+// Transaction groups writes so that they are applied all at once or not at all.
+// Reads made through a transaction see its own uncommitted writes.
+type Transaction interface {
+	Store
 
-	return data
+	// Commit atomically applies every write made in the transaction.
+	Commit() error
+
+	// Discard throws away every write made in the transaction. It does nothing if
+	// the transaction has already been committed or discarded.
+	Discard()
 }
 
-// Delete deletes an entry from the database.
-func Delete(identifier []byte) {
-	Coffer.Delete(identifier, nil)
+// DefaultPath returns the location of the coffer used when none is specified.
+func DefaultPath() (string, error) {
+	// Ascertain the path to the secret store.
+	user, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(user.HomeDir, ".dissident", "coffer"), nil
 }
 
-// Close closes the database object.
-func Close() {
-	Coffer.Close()
+// storageError wraps an error from a storage engine in ErrStorage.
+func storageError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %v", ErrStorage, err)
 }
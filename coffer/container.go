@@ -0,0 +1,919 @@
+package coffer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+var (
+	// ErrNotContainer is returned when opening a file that isn't a container.
+	ErrNotContainer = errors.New("! Not a dissident container")
+
+	// ErrContainerFull is returned when a container has nowhere left to put a value.
+	ErrContainerFull = errors.New("! The container is full")
+
+	// ErrNoRoomNearby is returned when every slot a value may be stored in is taken, but
+	// there is room elsewhere in the container, which the value can't be put in.
+	ErrNoRoomNearby = errors.New("! No room where this value belongs in the container; decoys elsewhere in it can't make room for it")
+
+	// ErrValueSize is returned when saving an identifier or value that isn't the size
+	// the container's slots hold.
+	ErrValueSize = errors.New("! Value does not fit the container's slots")
+
+	// ErrUnfinishedCommit is returned when opening a container read-only while a commit
+	// to it is still waiting to be undone.
+	ErrUnfinishedCommit = errors.New("! The container has an interrupted commit; open it for writing to undo it")
+
+	// ErrReadOnly is returned when writing to a container opened read-only.
+	ErrReadOnly = errors.New("! The container was opened read-only")
+)
+
+// Layout of a container.
+const (
+	// containerMagic starts every container.
+	containerMagic = "dissident-ctr-v1"
+
+	// containerHeaderSize is the size of the header, which holds the magic, the number
+	// and size of the slots and the vault parameters.
+	containerHeaderSize = 4096
+
+	// slotTagSize is the size of the tag stored at the start of each slot.
+	slotTagSize = 32
+
+	// slotProbes is how many slots, one after another, each value may be stored in.
+	slotProbes = 256
+
+	// slotContext and tagContext keep the hashes that place and tag values apart from
+	// each other and from every other hash.
+	slotContext = "dissident-slot-v1"
+	tagContext  = "dissident-tag-v1"
+
+	// journalMagic starts every journal, which is kept beside the container while a
+	// commit is written, in a file named after it with journalSuffix added.
+	journalMagic  = "dissident-jnl-v1"
+	journalSuffix = ".journal"
+)
+
+// Fixed is implemented by backends that hold a fixed number of values. They never have
+// room for a new value unless another is given up for it, and can't tell which values
+// may be given up by themselves.
+type Fixed interface {
+	Backend
+
+	// Reclaim lets values whose identifiers reclaimable accepts be overwritten to make
+	// room, and lets those values be put anywhere there is room. Calling it with nil
+	// stops this.
+	Reclaim(reclaimable func(identifier []byte) bool)
+}
+
+// Container is a Fixed backend that stores the coffer in a single file of a fixed size,
+// filled with random bytes when it is created. After a short header the file is a table
+// of slots, each holding a tag and a value of the same size. Each value is kept in one of
+// a run of slots starting at a hash of its identifier, under a different hash of it, so
+// without the identifier nothing ties a value to where it is. Values that may be
+// reclaimed are never looked up, so they are kept in unused slots picked at random, under
+// their identifiers; spread out like that, every run has some to give up. Nothing
+// records which slots are in use, so unused ones can't be told apart from the rest.
+//
+// Since the container can't tell either, it only knows that a slot is unused if it was
+// created or emptied since the container was opened. Slots left unused when it is closed
+// can only be reclaimed through Reclaim from then on.
+type Container struct {
+	sync.Mutex
+	file      *os.File
+	slots     uint64
+	valueSize int
+	params    []byte
+	modTime   time.Time
+	readOnly  bool
+
+	// Slots known to be unused, one bit each, and how many there are.
+	free        []uint64
+	freeCount   uint64
+	reclaimable func(identifier []byte) bool
+
+	// What a commit will write, by offset, while it is being worked out.
+	pending map[int64][]byte
+}
+
+// CreateContainer creates a container of size bytes at path whose slots each hold a value
+// of valueSize bytes. Every slot is random, and known to be unused until the container
+// is closed. The file must not already exist.
+func CreateContainer(path string, size int64, valueSize int) (*Container, error) {
+	if valueSize < 1 || size < containerHeaderSize+slotTagSize+int64(valueSize) {
+		return nil, errors.New("! Container is too small to hold anything")
+	}
+	slots := uint64(size-containerHeaderSize) / uint64(slotTagSize+valueSize)
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	c := &Container{file: file, slots: slots, valueSize: valueSize, free: make([]uint64, (slots+63)/64)}
+	for i := uint64(0); i < slots; i++ {
+		c.setFree(i, true)
+	}
+
+	// Fill everything with random bytes, then write the header over the start.
+	if err := c.fill(containerHeaderSize + int64(slots)*int64(slotTagSize+valueSize)); err != nil {
+		file.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	if err := c.writeHeader(); err != nil {
+		file.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(path)
+		return nil, storageError(err)
+	}
+
+	return c, nil
+}
+
+// OpenContainer opens the container at path. Its modification time is put back when it
+// is closed, so that it doesn't show when it was last used. If a commit was interrupted,
+// whatever it had written is undone first.
+func OpenContainer(path string) (*Container, error) {
+	return openContainer(path, false)
+}
+
+// OpenContainerReadOnly opens the container at path without changing anything, for
+// inspecting it. Anything written to it gives ErrReadOnly. If a commit to it was interrupted, it
+// gives ErrUnfinishedCommit, since undoing that would change it.
+func OpenContainerReadOnly(path string) (*Container, error) {
+	return openContainer(path, true)
+}
+
+func openContainer(path string, readOnly bool) (*Container, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	flag := os.O_RDWR
+	if readOnly {
+		flag = os.O_RDONLY
+		if _, err := os.Stat(path + journalSuffix); err == nil {
+			return nil, ErrUnfinishedCommit
+		}
+	}
+	file, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return nil, err
+	}
+	if !readOnly {
+		if err := recoverJournal(file, info.Size()); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	header := make([]byte, containerHeaderSize)
+	if _, err := io.ReadFull(file, header); err != nil || !bytes.Equal(header[:16], []byte(containerMagic)) {
+		file.Close()
+		return nil, ErrNotContainer
+	}
+	c := &Container{
+		file:      file,
+		slots:     binary.LittleEndian.Uint64(header[16:]),
+		valueSize: int(binary.LittleEndian.Uint32(header[24:])),
+		readOnly:  readOnly,
+	}
+	if !readOnly {
+		c.modTime = info.ModTime()
+	}
+	if length := binary.LittleEndian.Uint32(header[28:]); length != 0 {
+		if length > containerHeaderSize-32 {
+			file.Close()
+			return nil, ErrNotContainer
+		}
+		c.params = append([]byte{}, header[32:32+length]...)
+	}
+	if c.slots == 0 || c.valueSize == 0 || info.Size() < containerHeaderSize+int64(c.slots)*int64(slotTagSize+c.valueSize) {
+		file.Close()
+		return nil, ErrNotContainer
+	}
+
+	return c, nil
+}
+
+// IsContainer reports whether the file at path is a container.
+func IsContainer(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	magic := make([]byte, len(containerMagic))
+	_, err = io.ReadFull(file, magic)
+	return err == nil && bytes.Equal(magic, []byte(containerMagic))
+}
+
+// ValueSize returns the size of the values the container holds.
+func (c *Container) ValueSize() int {
+	return c.valueSize
+}
+
+// Slots returns how many values the container holds.
+func (c *Container) Slots() uint64 {
+	return c.slots
+}
+
+// Reclaim lets values whose identifiers reclaimable accepts be overwritten.
+func (c *Container) Reclaim(reclaimable func(identifier []byte) bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.reclaimable = reclaimable
+}
+
+// Exists checks if an entry exists and returns true or false.
+func (c *Container) Exists(identifier []byte) (bool, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if bytes.Equal(identifier, ParamsKey) {
+		return c.params != nil, nil
+	}
+	_, found, err := c.find(identifier)
+	return found, err
+}
+
+// Retrieve retrieves a secret from the container.
+func (c *Container) Retrieve(identifier []byte) ([]byte, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if bytes.Equal(identifier, ParamsKey) {
+		return append([]byte(nil), c.params...), nil
+	}
+	slot, found, err := c.find(identifier)
+	if err != nil || !found {
+		return nil, err
+	}
+	_, value, err := c.readSlot(slot)
+	return value, err
+}
+
+// Save saves a secret to the container, in place of a reclaimable value if it is new.
+func (c *Container) Save(identifier, ciphertext []byte) error {
+	return c.apply([]containerWrite{{identifier, ciphertext, false}})
+}
+
+// Delete deletes an entry from the container, filling its slot with random bytes.
+func (c *Container) Delete(identifier []byte) error {
+	return c.apply([]containerWrite{{identifier, nil, true}})
+}
+
+// Walk calls fn with the tag and value in every slot, used or not, since they can't be
+// told apart. Only values that may be reclaimed are tagged with their identifiers.
+func (c *Container) Walk(fn func(identifier, ciphertext []byte) error) error {
+	for i := uint64(0); i < c.slots; i++ {
+		c.Lock()
+		tag, value, err := c.readSlot(i)
+		c.Unlock()
+		if err != nil {
+			return err
+		}
+		if err := fn(tag, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Begin starts a transaction. Writes are buffered until they are committed, and then
+// applied all at once through a journal, so that even if the program is interrupted
+// either all of them are made or none are.
+func (c *Container) Begin() (Transaction, error) {
+	return &containerTransaction{c: c, writes: make(map[string]int)}, nil
+}
+
+// Close closes the file, putting its modification time back.
+func (c *Container) Close() error {
+	c.Lock()
+	defer c.Unlock()
+
+	err := c.file.Close()
+	if err == nil && !c.modTime.IsZero() {
+		err = os.Chtimes(c.file.Name(), time.Now(), c.modTime)
+	}
+	return storageError(err)
+}
+
+// containerWrite is a save or a delete waiting to be applied.
+type containerWrite struct {
+	identifier []byte
+	value      []byte
+	delete     bool
+}
+
+// slotUndo is whether a slot was known to be unused before it was written to.
+type slotUndo struct {
+	slot uint64
+	free bool
+}
+
+// apply makes every write in order, or none of them. Where each one goes is worked out
+// before anything is written, and then written by flush.
+func (c *Container) apply(writes []containerWrite) error {
+	c.Lock()
+	defer c.Unlock()
+	if c.readOnly {
+		return ErrReadOnly
+	}
+
+	params := c.params
+	var undo []slotUndo
+	c.pending = make(map[int64][]byte)
+	defer func() { c.pending = nil }()
+
+	err := func() error {
+		for _, w := range writes {
+			if err := c.write(w, &undo); err != nil {
+				return err
+			}
+		}
+		return c.flush()
+	}()
+	if err != nil {
+		for i := len(undo) - 1; i >= 0; i-- {
+			c.setFree(undo[i].slot, undo[i].free)
+		}
+		c.params = params
+	}
+	return err
+}
+
+// flush writes everything that is pending. What it overwrites is copied to the journal
+// first, and the journal is only shredded once the writes have reached the disk, so if
+// they are interrupted the next OpenContainer puts it all back.
+func (c *Container) flush() error {
+	if len(c.pending) == 0 {
+		return nil
+	}
+	offsets := make([]int64, 0, len(c.pending))
+	for offset := range c.pending {
+		offsets = append(offsets, offset)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	// The journal comes and goes beside the container, so put the directory's
+	// modification time back afterwards too.
+	dir := filepath.Dir(c.file.Name())
+	if info, err := os.Stat(dir); err == nil {
+		defer os.Chtimes(dir, time.Now(), info.ModTime())
+	}
+
+	old, err := c.journal(offsets)
+	if err != nil {
+		return err
+	}
+	for _, offset := range offsets {
+		if _, err = c.file.WriteAt(c.pending[offset], offset); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = c.file.Sync()
+	}
+	if err != nil {
+		// If even this fails, the journal is left for the next OpenContainer.
+		if c.restore(old) == nil {
+			endJournal(c.file.Name())
+		}
+		return storageError(err)
+	}
+
+	return endJournal(c.file.Name())
+}
+
+// journalRecord is what was in the file at an offset before a commit.
+type journalRecord struct {
+	offset int64
+	data   []byte
+}
+
+// journal copies what is at each offset, as much of it as is about to be overwritten,
+// into a new journal that has reached the disk, and returns the copies.
+func (c *Container) journal(offsets []int64) ([]journalRecord, error) {
+	records := make([]journalRecord, len(offsets))
+	for i, offset := range offsets {
+		data := make([]byte, len(c.pending[offset]))
+		if _, err := c.file.ReadAt(data, offset); err != nil {
+			return nil, storageError(err)
+		}
+		records[i] = journalRecord{offset, data}
+	}
+
+	// The journal is its magic, each record as its offset, its length and its data,
+	// and then a hash of all of that, so that one that was cut short is ignored.
+	journal := []byte(journalMagic)
+	for _, r := range records {
+		var lengths [12]byte
+		binary.LittleEndian.PutUint64(lengths[:], uint64(r.offset))
+		binary.LittleEndian.PutUint32(lengths[8:], uint32(len(r.data)))
+		journal = append(append(journal, lengths[:]...), r.data...)
+	}
+	sum := blake2b.Sum256(journal)
+	journal = append(journal, sum[:]...)
+
+	path := c.file.Name() + journalSuffix
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, storageError(err)
+	}
+	_, err = file.Write(journal)
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		endJournal(c.file.Name())
+		return nil, storageError(err)
+	}
+	syncDir(filepath.Dir(path))
+
+	return records, nil
+}
+
+// restore writes records back to the file.
+func (c *Container) restore(records []journalRecord) error {
+	for _, r := range records {
+		if _, err := c.file.WriteAt(r.data, r.offset); err != nil {
+			return storageError(err)
+		}
+	}
+	return storageError(c.file.Sync())
+}
+
+// endJournal shreds and removes the journal of the container at path, once it is no
+// longer needed. Once shredded it no longer matches its hash, so even if removing it
+// doesn't reach the disk it is ignored.
+func endJournal(path string) error {
+	path += journalSuffix
+	if err := shredFile(path); err != nil && !os.IsNotExist(err) {
+		return storageError(err)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return storageError(err)
+	}
+	return nil
+}
+
+// recoverJournal undoes a commit to the container open in file, which is size bytes
+// long, that was interrupted, if there is one. A journal that was cut short was still
+// being written when it was, so nothing it covers had been touched yet.
+func recoverJournal(file *os.File, size int64) error {
+	journal, err := ioutil.ReadFile(file.Name() + journalSuffix)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return storageError(err)
+	}
+	if records, ok := parseJournal(journal, size); ok {
+		c := &Container{file: file}
+		if err := c.restore(records); err != nil {
+			return err
+		}
+	}
+	return endJournal(file.Name())
+}
+
+// parseJournal parses a journal of a file size bytes long, returning false if it is
+// incomplete or doesn't fit the file.
+func parseJournal(journal []byte, size int64) ([]journalRecord, bool) {
+	if len(journal) < len(journalMagic)+blake2b.Size256 || !bytes.Equal(journal[:len(journalMagic)], []byte(journalMagic)) {
+		return nil, false
+	}
+	body, sum := journal[:len(journal)-blake2b.Size256], journal[len(journal)-blake2b.Size256:]
+	if expected := blake2b.Sum256(body); !bytes.Equal(sum, expected[:]) {
+		return nil, false
+	}
+
+	var records []journalRecord
+	for rest := body[len(journalMagic):]; len(rest) > 0; {
+		if len(rest) < 12 {
+			return nil, false
+		}
+		offset, length := binary.LittleEndian.Uint64(rest), uint64(binary.LittleEndian.Uint32(rest[8:]))
+		rest = rest[12:]
+		if uint64(len(rest)) < length || offset > uint64(size) || offset+length > uint64(size) {
+			return nil, false
+		}
+		records = append(records, journalRecord{int64(offset), rest[:length]})
+		rest = rest[length:]
+	}
+	return records, true
+}
+
+// syncDir makes sure that files created in the directory at path have reached the disk,
+// where the platform allows it.
+func syncDir(path string) {
+	if dir, err := os.Open(path); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+}
+
+// write works out a single save or delete, recording the slots it uses in undo.
+func (c *Container) write(w containerWrite, undo *[]slotUndo) error {
+	if bytes.Equal(w.identifier, ParamsKey) {
+		if len(w.value) > containerHeaderSize-32 {
+			return ErrValueSize
+		}
+		c.params = nil
+		if !w.delete {
+			c.params = append([]byte{}, w.value...)
+		}
+		return c.writeHeader()
+	}
+
+	if len(w.identifier) != slotTagSize {
+		return ErrValueSize
+	}
+	slots, tags, err := c.probes(w.identifier)
+	if err != nil {
+		return err
+	}
+	slot, found := lookup(slots, tags, w.identifier)
+
+	// Deleted values are replaced with random bytes, and their slot can be used again.
+	if w.delete {
+		if !found {
+			return nil
+		}
+		random := make([]byte, slotTagSize+c.valueSize)
+		if _, err := rand.Read(random); err != nil {
+			return err
+		}
+		if err := c.overwrite(slot, random[:slotTagSize], random[slotTagSize:], undo); err != nil {
+			return err
+		}
+		c.setFree(slot, true)
+		return nil
+	}
+
+	if len(w.value) != c.valueSize {
+		return ErrValueSize
+	}
+	if found {
+		return c.overwrite(slot, slotTag(w.identifier), w.value, undo)
+	}
+
+	// Values that may be reclaimed are never looked up, so they can go in any unused
+	// slot, but aren't worth giving anything else up for.
+	if c.reclaimable != nil && c.reclaimable(w.identifier) {
+		slot, ok, err := c.popFree()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrContainerFull
+		}
+		return c.overwrite(slot, w.identifier, w.value, undo)
+	}
+
+	// Otherwise it goes in the first of its slots that is unused or may be reclaimed.
+	for i, slot := range slots {
+		if c.isFree(slot) || c.reclaimable != nil && c.reclaimable(tags[i]) {
+			return c.overwrite(slot, slotTag(w.identifier), w.value, undo)
+		}
+	}
+
+	// Room elsewhere, which is all that is known of once the container has been
+	// reopened, is no use to it.
+	elsewhere, err := c.roomElsewhere()
+	if err != nil {
+		return err
+	}
+	if elsewhere {
+		return ErrNoRoomNearby
+	}
+	return ErrContainerFull
+}
+
+// find looks for identifier in each of its slots.
+func (c *Container) find(identifier []byte) (uint64, bool, error) {
+	slots, tags, err := c.probes(identifier)
+	if err != nil {
+		return 0, false, err
+	}
+	slot, found := lookup(slots, tags, identifier)
+	return slot, found, nil
+}
+
+// lookup returns which of slots, holding tags, identifier is stored in.
+func lookup(slots []uint64, tags [][]byte, identifier []byte) (uint64, bool) {
+	tag := slotTag(identifier)
+	for i, stored := range tags {
+		if bytes.Equal(stored, tag) {
+			return slots[i], true
+		}
+	}
+	return 0, false
+}
+
+// probes returns the slots identifier may be stored in, in the order they are tried,
+// and the tag in each. They follow one another, so they are read all at once, or in two
+// reads if they wrap around to the start of the table.
+func (c *Container) probes(identifier []byte) ([]uint64, [][]byte, error) {
+	h := blake2b.Sum256(append([]byte(slotContext), identifier...))
+	start := binary.LittleEndian.Uint64(h[:]) % c.slots
+
+	n := uint64(slotProbes)
+	if n > c.slots {
+		n = c.slots
+	}
+	size := uint64(slotTagSize + c.valueSize)
+	buf := make([]byte, n*size)
+	before := n
+	if start+n > c.slots {
+		before = c.slots - start
+	}
+	if err := c.readAt(buf[:before*size], c.offset(start)); err != nil {
+		return nil, nil, err
+	}
+	if before < n {
+		if err := c.readAt(buf[before*size:], c.offset(0)); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	slots := make([]uint64, n)
+	tags := make([][]byte, n)
+	for i := range slots {
+		slots[i] = (start + uint64(i)) % c.slots
+		tags[i] = buf[uint64(i)*size:][:slotTagSize]
+	}
+	return slots, tags, nil
+}
+
+// roomElsewhere reports whether any slot is unused or holds a value that may be
+// reclaimed, reading the table a run of slots at a time.
+func (c *Container) roomElsewhere() (bool, error) {
+	if c.freeCount > 0 {
+		return true, nil
+	}
+	if c.reclaimable == nil {
+		return false, nil
+	}
+
+	size := uint64(slotTagSize + c.valueSize)
+	buf := make([]byte, slotProbes*size)
+	for first := uint64(0); first < c.slots; first += slotProbes {
+		n := c.slots - first
+		if n > slotProbes {
+			n = slotProbes
+		}
+		if err := c.readAt(buf[:n*size], c.offset(first)); err != nil {
+			return false, err
+		}
+		for i := uint64(0); i < n; i++ {
+			if c.reclaimable(buf[i*size:][:slotTagSize]) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// slotTag returns the tag identifier is stored under.
+func slotTag(identifier []byte) []byte {
+	h := blake2b.Sum256(append([]byte(tagContext), identifier...))
+	return h[:]
+}
+
+// overwrite writes to a slot, first recording whether it was unused in undo.
+func (c *Container) overwrite(slot uint64, tag, value []byte, undo *[]slotUndo) error {
+	*undo = append(*undo, slotUndo{slot, c.isFree(slot)})
+	c.setFree(slot, false)
+
+	return c.writeSlot(slot, tag, value)
+}
+
+// offset returns where a slot starts in the file.
+func (c *Container) offset(slot uint64) int64 {
+	return containerHeaderSize + int64(slot)*int64(slotTagSize+c.valueSize)
+}
+
+func (c *Container) readSlot(slot uint64) ([]byte, []byte, error) {
+	buf := make([]byte, slotTagSize+c.valueSize)
+	if err := c.readAt(buf, c.offset(slot)); err != nil {
+		return nil, nil, err
+	}
+	return buf[:slotTagSize], buf[slotTagSize:], nil
+}
+
+func (c *Container) writeSlot(slot uint64, tag, value []byte) error {
+	return c.writeAt(append(append([]byte{}, tag...), value...), c.offset(slot))
+}
+
+// readAt reads whole slots from the file, starting with the one at offset, as they will
+// be once what is pending is written.
+func (c *Container) readAt(buf []byte, offset int64) error {
+	if _, err := c.file.ReadAt(buf, offset); err != nil {
+		return storageError(err)
+	}
+	if len(c.pending) == 0 {
+		return nil
+	}
+	size := slotTagSize + c.valueSize
+	for i := 0; i < len(buf); i += size {
+		if data, ok := c.pending[offset+int64(i)]; ok {
+			copy(buf[i:], data)
+		}
+	}
+	return nil
+}
+
+// writeAt writes data to the file at offset, or holds it back while a commit is being
+// worked out.
+func (c *Container) writeAt(data []byte, offset int64) error {
+	if c.pending != nil {
+		c.pending[offset] = data
+		return nil
+	}
+	_, err := c.file.WriteAt(data, offset)
+	return storageError(err)
+}
+
+// writeHeader writes the header, padded with random bytes.
+func (c *Container) writeHeader() error {
+	header := make([]byte, containerHeaderSize)
+	if _, err := rand.Read(header); err != nil {
+		return err
+	}
+	copy(header, containerMagic)
+	binary.LittleEndian.PutUint64(header[16:], c.slots)
+	binary.LittleEndian.PutUint32(header[24:], uint32(c.valueSize))
+	binary.LittleEndian.PutUint32(header[28:], uint32(len(c.params)))
+	copy(header[32:], c.params)
+
+	return c.writeAt(header, 0)
+}
+
+// fill writes size random bytes to the file.
+func (c *Container) fill(size int64) error {
+	buf := make([]byte, 1<<20)
+	for written := int64(0); written < size; written += int64(len(buf)) {
+		if size-written < int64(len(buf)) {
+			buf = buf[:size-written]
+		}
+		if _, err := rand.Read(buf); err != nil {
+			return err
+		}
+		if _, err := c.file.WriteAt(buf, written); err != nil {
+			return storageError(err)
+		}
+	}
+	return nil
+}
+
+func (c *Container) isFree(slot uint64) bool {
+	return c.free != nil && c.free[slot/64]&(1<<(slot%64)) != 0
+}
+
+func (c *Container) setFree(slot uint64, free bool) {
+	if c.free == nil {
+		if !free {
+			return
+		}
+		c.free = make([]uint64, (c.slots+63)/64)
+	}
+	if free == c.isFree(slot) {
+		return
+	}
+	if free {
+		c.free[slot/64] |= 1 << (slot % 64)
+		c.freeCount++
+	} else {
+		c.free[slot/64] &^= 1 << (slot % 64)
+		c.freeCount--
+	}
+}
+
+// popFree returns a slot known to be unused, chosen at random, if there is one. It isn't
+// marked as used until it is written to.
+func (c *Container) popFree() (uint64, bool, error) {
+	if c.freeCount == 0 {
+		return 0, false, nil
+	}
+
+	// Guessing is quickest while plenty of slots are free.
+	for i := 0; i < 64; i++ {
+		slot, err := randomBelow(c.slots)
+		if err != nil {
+			return 0, false, err
+		}
+		if c.isFree(slot) {
+			return slot, true, nil
+		}
+	}
+
+	// Otherwise pick one of the free slots by counting through them.
+	n, err := randomBelow(c.freeCount)
+	if err != nil {
+		return 0, false, err
+	}
+	for i, word := range c.free {
+		if ones := uint64(bits.OnesCount64(word)); n >= ones {
+			n -= ones
+			continue
+		}
+		for ; n > 0; n-- {
+			word &= word - 1
+		}
+		return uint64(i)*64 + uint64(bits.TrailingZeros64(word)), true, nil
+	}
+	return 0, false, nil
+}
+
+// randomBelow returns a uniformly random number less than n.
+func randomBelow(n uint64) (uint64, error) {
+	r, err := rand.Int(rand.Reader, new(big.Int).SetUint64(n))
+	if err != nil {
+		return 0, err
+	}
+	return r.Uint64(), nil
+}
+
+// containerTransaction is a Transaction on a Container.
+type containerTransaction struct {
+	c      *Container
+	order  []containerWrite
+	writes map[string]int
+	done   bool
+}
+
+func (t *containerTransaction) Exists(identifier []byte) (bool, error) {
+	if i, ok := t.writes[string(identifier)]; ok {
+		return !t.order[i].delete, nil
+	}
+	return t.c.Exists(identifier)
+}
+
+func (t *containerTransaction) Save(identifier, ciphertext []byte) error {
+	return t.add(containerWrite{append([]byte{}, identifier...), append([]byte{}, ciphertext...), false})
+}
+
+func (t *containerTransaction) Retrieve(identifier []byte) ([]byte, error) {
+	if i, ok := t.writes[string(identifier)]; ok {
+		if t.order[i].delete {
+			return nil, nil
+		}
+		return append([]byte{}, t.order[i].value...), nil
+	}
+	return t.c.Retrieve(identifier)
+}
+
+func (t *containerTransaction) Delete(identifier []byte) error {
+	return t.add(containerWrite{append([]byte{}, identifier...), nil, true})
+}
+
+// add records a write, replacing any earlier one to the same identifier.
+func (t *containerTransaction) add(w containerWrite) error {
+	if t.done {
+		return errTransactionDone
+	}
+	if i, ok := t.writes[string(w.identifier)]; ok {
+		t.order[i] = w
+		return nil
+	}
+	t.writes[string(w.identifier)] = len(t.order)
+	t.order = append(t.order, w)
+	return nil
+}
+
+func (t *containerTransaction) Commit() error {
+	if t.done {
+		return errTransactionDone
+	}
+	t.done = true
+
+	return t.c.apply(t.order)
+}
+
+func (t *containerTransaction) Discard() {
+	t.done = true
+}
@@ -0,0 +1,380 @@
+package coffer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testSlot returns a 32-byte identifier and a 64-byte value made from b.
+func testSlot(b byte) ([]byte, []byte) {
+	return bytes.Repeat([]byte{b}, slotTagSize), bytes.Repeat([]byte{b}, 64)
+}
+
+func TestContainer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dissident")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "container")
+	size := int64(containerHeaderSize + 100*(slotTagSize+64))
+	c, err := CreateContainer(path, size, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() != size {
+		t.Fatal("Expected a file of", size, "bytes; got", info, err)
+	}
+	if c.Slots() != 100 || !IsContainer(path) {
+		t.Error("Expected a container of 100 slots; got", c.Slots())
+	}
+
+	// Only values of the right size fit.
+	if err := c.Save(bytes.Repeat([]byte{1}, slotTagSize), []byte("short")); err != ErrValueSize {
+		t.Error("Expected ErrValueSize; got", err)
+	}
+	if err := c.Save([]byte("short"), make([]byte, 64)); err != ErrValueSize {
+		t.Error("Expected ErrValueSize; got", err)
+	}
+
+	// Every slot known to be unused can be filled, since there are fewer than a value
+	// may be stored in.
+	for i := 0; i < 100; i++ {
+		id, value := testSlot(byte(i))
+		if err := c.Save(id, value); err != nil {
+			t.Fatal("Failed to save value", i, err)
+		}
+	}
+	id, value := testSlot(100)
+	if err := c.Save(id, value); err != ErrContainerFull {
+		t.Error("Expected ErrContainerFull; got", err)
+	}
+
+	// Nothing is stored under its identifier, which would give away where it belongs.
+	c.Walk(func(tag, _ []byte) error {
+		if tag[0] == tag[1] && tag[1] == tag[slotTagSize-1] {
+			t.Fatal("Found a value stored under its identifier")
+		}
+		return nil
+	})
+	if err := c.Save(ParamsKey, []byte("params")); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	// Reopening finds everything, and the file's modification time is left alone.
+	old := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	os.Chtimes(path, old, old)
+	if c, err = OpenContainer(path); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		id, value := testSlot(byte(i))
+		if !bytes.Equal(retrieve(t, c, string(id)), value) {
+			t.Fatal("Value", i, "did not survive reopening")
+		}
+	}
+	if !bytes.Equal(retrieve(t, c, string(ParamsKey)), []byte("params")) {
+		t.Error("Parameters did not survive reopening")
+	}
+
+	// A deleted slot can be used again straight away.
+	id, value = testSlot(5)
+	if err := c.Delete(id); err != nil || exists(t, c, string(id)) {
+		t.Fatal("Failed to delete:", err)
+	}
+	if err := c.Save(id, value); err != nil {
+		t.Error("Expected to reuse the deleted slot; got", err)
+	}
+	c.Close()
+	if info, err := os.Stat(path); err != nil || !info.ModTime().Equal(old) {
+		t.Error("Expected the modification time to be put back; got", info.ModTime(), err)
+	}
+	if info, _ := os.Stat(path); info.Size() != size {
+		t.Error("Container changed size to", info.Size())
+	}
+
+	// Opened read-only, it can be read but not written.
+	if c, err = OpenContainerReadOnly(path); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(retrieve(t, c, string(id)), value) {
+		t.Error("Value did not survive reopening")
+	}
+	if err := c.Delete(id); err != ErrReadOnly {
+		t.Error("Expected ErrReadOnly; got", err)
+	}
+	c.Close()
+	if info, err := os.Stat(path); err != nil || !info.ModTime().Equal(old) {
+		t.Error("Expected the modification time to be left alone; got", info.ModTime(), err)
+	}
+}
+
+func TestContainerReclaim(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dissident")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "container")
+	c, err := CreateContainer(path, containerHeaderSize+1000*(slotTagSize+64), 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fill it with values that may be reclaimed, which go anywhere.
+	reclaimable := func(identifier []byte) bool { return bytes.Equal(identifier[16:], bytes.Repeat([]byte{0xff}, 16)) }
+	c.Reclaim(reclaimable)
+	for i := 0; i < 1000; i++ {
+		id, value := testSlot(0xff)
+		id[1], id[2] = byte(i), byte(i>>8)
+		if err := c.Save(id, value); err != nil {
+			t.Fatal("Failed to save value", i, err)
+		}
+	}
+	c.Close()
+
+	// Once reopened, nothing is known to be unused, so there is only room for more
+	// values by reclaiming.
+	if c, err = OpenContainer(path); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	id, value := testSlot(1)
+	if err := c.Save(id, value); err != ErrContainerFull {
+		t.Error("Expected ErrContainerFull; got", err)
+	}
+
+	c.Reclaim(reclaimable)
+	tx, err := c.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 900; i++ {
+		id, value := testSlot(byte(i % 0xfe))
+		id[1], id[2] = byte(i), byte(i>>8)
+		tx.Save(id, value)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 900; i++ {
+		id, value := testSlot(byte(i % 0xfe))
+		id[1], id[2] = byte(i), byte(i>>8)
+		if !bytes.Equal(retrieve(t, c, string(id)), value) {
+			t.Fatal("Value", i, "was lost while making room")
+		}
+	}
+
+	// A transaction that doesn't fit is undone entirely.
+	tx, _ = c.Begin()
+	for i := 0; i < 200; i++ {
+		id, value := testSlot(0xfe)
+		id[1], id[2] = byte(i), byte(i>>8)
+		tx.Save(id, value)
+	}
+	// It runs out of room where one of them belongs while there are still values to
+	// reclaim elsewhere, or, if not, everywhere.
+	if err := tx.Commit(); err != ErrNoRoomNearby && err != ErrContainerFull {
+		t.Fatal("Expected ErrNoRoomNearby or ErrContainerFull; got", err)
+	}
+	for i := 0; i < 200; i++ {
+		id, _ := testSlot(0xfe)
+		id[1], id[2] = byte(i), byte(i>>8)
+		if exists(t, c, string(id)) {
+			t.Fatal("A value from the failed transaction was left behind")
+		}
+	}
+	reclaimed := 0
+	c.Walk(func(identifier, _ []byte) error {
+		if reclaimable(identifier) {
+			reclaimed++
+		}
+		return nil
+	})
+	if reclaimed != 100 {
+		t.Error("Expected 100 values left to reclaim; got", reclaimed)
+	}
+
+	// Values left to reclaim outside a value's run of slots don't make room for it, and
+	// saying the container is full would be wrong.
+	id, value = testSlot(0xfd)
+	_, tags, err := c.probes(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nearby := make(map[string]bool)
+	for _, tag := range tags {
+		nearby[string(tag)] = true
+	}
+	c.Reclaim(func(identifier []byte) bool { return reclaimable(identifier) && !nearby[string(identifier)] })
+	if err := c.Save(id, value); err != ErrNoRoomNearby {
+		t.Error("Expected ErrNoRoomNearby; got", err)
+	}
+	c.Reclaim(func([]byte) bool { return false })
+	if err := c.Save(id, value); err != ErrContainerFull {
+		t.Error("Expected ErrContainerFull; got", err)
+	}
+}
+
+func TestContainerSpread(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dissident")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Half fill a container many times bigger than a value's run of slots.
+	path := filepath.Join(dir, "container")
+	c, err := CreateContainer(path, containerHeaderSize+16*slotProbes*(slotTagSize+64), 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reclaimable := func(identifier []byte) bool { return bytes.Equal(identifier[16:], bytes.Repeat([]byte{0xff}, 16)) }
+	c.Reclaim(reclaimable)
+	for i := 0; i < 8*slotProbes; i++ {
+		id, value := testSlot(0xff)
+		id[1], id[2] = byte(i), byte(i>>8)
+		if err := c.Save(id, value); err != nil {
+			t.Fatal("Failed to save value", i, err)
+		}
+	}
+	c.Close()
+
+	// The values to reclaim are spread out, so there is room wherever a value belongs.
+	if c, err = OpenContainer(path); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Reclaim(reclaimable)
+	for i := 0; i < 2*slotProbes; i++ {
+		id, value := testSlot(byte(i % 0xfe))
+		id[1], id[2] = byte(i), byte(i>>8)
+		if err := c.Save(id, value); err != nil {
+			t.Fatal("Failed to save value", i, err)
+		}
+	}
+}
+
+func TestContainerJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dissident")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "container")
+	c, err := CreateContainer(path, containerHeaderSize+100*(slotTagSize+64), 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		id, value := testSlot(byte(i))
+		if err := c.Save(id, value); err != nil {
+			t.Fatal("Failed to save value", i, err)
+		}
+	}
+	c.Save(ParamsKey, []byte("params"))
+	c.Close()
+	before, _ := ioutil.ReadFile(path)
+
+	// Work out a commit and journal it, but stop after writing only some of it, as if
+	// the program had been killed.
+	if c, err = OpenContainer(path); err != nil {
+		t.Fatal(err)
+	}
+	var undo []slotUndo
+	c.pending = make(map[int64][]byte)
+	deleted, _ := testSlot(5)
+	id, value := testSlot(10)
+	for _, w := range []containerWrite{{deleted, nil, true}, {id, value, false}, {ParamsKey, []byte("changed"), false}} {
+		if err := c.write(w, &undo); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var offsets []int64
+	for offset := range c.pending {
+		offsets = append(offsets, offset)
+	}
+	if _, err := c.journal(offsets); err != nil {
+		t.Fatal(err)
+	}
+	journal, err := ioutil.ReadFile(path + journalSuffix)
+	if err != nil {
+		t.Fatal("Expected a journal; got", err)
+	}
+	for _, offset := range offsets[:2] {
+		c.file.WriteAt(c.pending[offset], offset)
+	}
+	c.file.Close()
+
+	// Opening it again undoes what was written, and the journal goes.
+	if c, err = OpenContainer(path); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if after, _ := ioutil.ReadFile(path); !bytes.Equal(before, after) {
+		t.Error("Expected the interrupted commit to be undone")
+	}
+	if _, err := os.Stat(path + journalSuffix); !os.IsNotExist(err) {
+		t.Error("Expected the journal to be removed; got", err)
+	}
+
+	// A journal that was cut short is only removed, since nothing it covers was touched.
+	ioutil.WriteFile(path+journalSuffix, journal[:len(journal)-1], 0600)
+	if c, err = OpenContainer(path); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := os.Stat(path + journalSuffix); !os.IsNotExist(err) {
+		t.Error("Expected the journal to be removed; got", err)
+	}
+	for i := 0; i < 10; i++ {
+		id, value := testSlot(byte(i))
+		if !bytes.Equal(retrieve(t, c, string(id)), value) {
+			t.Fatal("Value", i, "was lost")
+		}
+	}
+
+	// One that is opened read-only can't undo it.
+	ioutil.WriteFile(path+journalSuffix, journal, 0600)
+	if _, err := OpenContainerReadOnly(path); err != ErrUnfinishedCommit {
+		t.Error("Expected ErrUnfinishedCommit; got", err)
+	}
+	os.Remove(path + journalSuffix)
+
+	// A commit that goes through leaves no journal behind.
+	id, value = testSlot(3)
+	if err := c.Save(id, bytes.Repeat([]byte{9}, 64)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + journalSuffix); !os.IsNotExist(err) {
+		t.Error("Expected the journal to be removed; got", err)
+	}
+}
+
+func TestOpenContainerInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dissident")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "file")
+	ioutil.WriteFile(path, bytes.Repeat([]byte("x"), containerHeaderSize*2), 0600)
+	if _, err := OpenContainer(path); err != ErrNotContainer {
+		t.Error("Expected ErrNotContainer; got", err)
+	}
+	if IsContainer(path) || IsContainer(dir) {
+		t.Error("Expected not to be taken for a container")
+	}
+	if _, err := CreateContainer(path, 1<<20, 64); err == nil {
+		t.Error("Expected not to overwrite an existing file")
+	}
+}
@@ -0,0 +1,345 @@
+package coffer
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// LevelDB is a Backend that stores the coffer in a LevelDB database. Files LevelDB no
+// longer needs are overwritten before they are removed.
+type LevelDB struct {
+	db   *leveldb.DB
+	stor storage.Storage
+}
+
+// OpenLevelDB opens the LevelDB database at path. If create is false the database
+// must already exist; otherwise it is created, along with any missing parent
+// directories. A rewrite of it that was interrupted is dealt with first.
+func OpenLevelDB(path string, create bool) (*LevelDB, error) {
+	if err := FinishRewrite(path); err != nil {
+		return nil, err
+	}
+	if create {
+		// Keep the directories holding the coffer private.
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, err
+		}
+	} else if _, err := os.Stat(path); err != nil {
+		// LevelDB would otherwise create the directory before noticing it is empty.
+		return nil, err
+	}
+
+	// Open the database file.
+	stor, err := storage.OpenFile(path, false)
+	if err != nil {
+		return nil, storageError(err)
+	}
+	db, err := leveldb.Open(&shreddingStorage{stor, path}, &opt.Options{ErrorIfMissing: !create})
+	if err != nil {
+		stor.Close()
+		return nil, storageError(err)
+	}
+
+	return &LevelDB{db: db, stor: stor}, nil
+}
+
+// OpenLevelDBReadOnly opens the existing LevelDB database at path without changing
+// anything, for inspecting it. Anything written to it fails.
+func OpenLevelDBReadOnly(path string) (*LevelDB, error) {
+	stor, err := storage.OpenFile(path, true)
+	if err != nil {
+		return nil, storageError(err)
+	}
+	db, err := leveldb.Open(stor, &opt.Options{ErrorIfMissing: true, ReadOnly: true})
+	if err != nil {
+		stor.Close()
+		return nil, storageError(err)
+	}
+
+	return &LevelDB{db: db, stor: stor}, nil
+}
+
+// RewriteLevelDB copies the database at path, which must not be open, into a new one in
+// a random order, then shreds the old one. LevelDB numbers every write and keeps the
+// numbers, so this hides the order values were written in, along with anything deleted
+// that was still waiting to be compacted away.
+//
+// A marker is left in path+".rewriting" until it is done. The copy is made in
+// path+".rewrite" and renamed to path+".new" once it is complete. The old database is
+// then renamed to path+".old", the copy to path, and the old one is shredded. If this is
+// interrupted, FinishRewrite picks up from wherever it stopped. Nothing may already be
+// at any of those paths.
+func RewriteLevelDB(path string) error {
+	old, err := OpenLevelDB(path, false)
+	if err != nil {
+		return err
+	}
+	for _, suffix := range []string{".rewriting", ".rewrite", ".new", ".old"} {
+		if _, err := os.Lstat(path + suffix); !os.IsNotExist(err) {
+			old.Close()
+			return fmt.Errorf("! %s is in the way of rewriting the database", path+suffix)
+		}
+	}
+
+	// The marker has to reach the disk before anything it lets FinishRewrite remove.
+	marker, err := os.OpenFile(path+".rewriting", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err == nil {
+		err = marker.Sync()
+		if cerr := marker.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		old.Close()
+		return err
+	}
+	syncDir(filepath.Dir(path))
+
+	err = copyLevelDB(old, path+".rewrite")
+	if cerr := old.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	// Swap it in, then shred the old one.
+	if err := os.Rename(path+".rewrite", path+".new"); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(path))
+	return FinishRewrite(path)
+}
+
+// copyLevelDB copies every value in old into a new, compacted, database at path, in a
+// random order.
+func copyLevelDB(old *LevelDB, path string) error {
+	// Shuffle the identifiers.
+	var identifiers [][]byte
+	err := old.Walk(func(identifier, _ []byte) error {
+		identifiers = append(identifiers, identifier)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(identifiers) - 1; i > 0; i-- {
+		j, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+		if err != nil {
+			return err
+		}
+		identifiers[i], identifiers[j.Int64()] = identifiers[j.Int64()], identifiers[i]
+	}
+
+	fresh, err := OpenLevelDB(path, true)
+	if err != nil {
+		return err
+	}
+	tx, err := fresh.Begin()
+	if err != nil {
+		fresh.Close()
+		return err
+	}
+	for _, identifier := range identifiers {
+		value, err := old.Retrieve(identifier)
+		if err == nil {
+			err = tx.Save(identifier, value)
+		}
+		if err != nil {
+			tx.Discard()
+			fresh.Close()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		fresh.Close()
+		return err
+	}
+	if err := fresh.Compact(); err != nil {
+		fresh.Close()
+		return err
+	}
+	return fresh.Close()
+}
+
+// FinishRewrite finishes a RewriteLevelDB of the database at path that was interrupted.
+// A copy that was still being made is shredded, and the old database is kept; a
+// complete one is swapped in, and the old database shredded. Unless the marker
+// RewriteLevelDB leaves is there, it touches nothing.
+func FinishRewrite(path string) error {
+	if _, err := os.Stat(path + ".rewriting"); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if err := shredDir(path + ".rewrite"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if _, err := os.Stat(path + ".new"); err == nil {
+		// Move the old database out of the way, unless that was already done.
+		if _, err := os.Stat(path); err == nil {
+			if err := shredDir(path + ".old"); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err := os.Rename(path, path+".old"); err != nil {
+				return err
+			}
+		}
+		if err := os.Rename(path+".new", path); err != nil {
+			return err
+		}
+		syncDir(filepath.Dir(path))
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := shredDir(path + ".old"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(path + ".rewriting")
+}
+
+// Exists checks if an entry exists and returns true or false.
+func (l *LevelDB) Exists(identifier []byte) (bool, error) {
+	exists, err := l.db.Has(identifier, nil)
+	return exists, storageError(err)
+}
+
+// Save saves a secret to the database.
+func (l *LevelDB) Save(identifier, ciphertext []byte) error {
+	return storageError(l.db.Put(identifier, ciphertext, nil))
+}
+
+// Retrieve retrieves a secret from the database.
+func (l *LevelDB) Retrieve(identifier []byte) ([]byte, error) {
+	data, err := l.db.Get(identifier, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+
+	return data, storageError(err)
+}
+
+// Delete deletes an entry from the database.
+func (l *LevelDB) Delete(identifier []byte) error {
+	return storageError(l.db.Delete(identifier, nil))
+}
+
+// Walk iterates over a snapshot of the database, so fn may change it.
+func (l *LevelDB) Walk(fn func(identifier, ciphertext []byte) error) error {
+	it := l.db.NewIterator(nil, nil)
+	defer it.Release()
+
+	for it.Next() {
+		if err := fn(append([]byte{}, it.Key()...), append([]byte{}, it.Value()...)); err != nil {
+			return err
+		}
+	}
+	return storageError(it.Error())
+}
+
+// Compact compacts the whole database, so that nothing deleted is left in it, and
+// shreds the files it no longer needs.
+func (l *LevelDB) Compact() error {
+	return storageError(l.db.CompactRange(util.Range{}))
+}
+
+// Close closes the database object.
+func (l *LevelDB) Close() error {
+	err := l.db.Close()
+	if serr := l.stor.Close(); err == nil && serr != storage.ErrClosed {
+		err = serr
+	}
+	return storageError(err)
+}
+
+// Begin opens a LevelDB transaction. Uncommitted tables are removed by LevelDB
+// the next time the database is opened, so an interrupted transaction leaves
+// no trace.
+func (l *LevelDB) Begin() (Transaction, error) {
+	tr, err := l.db.OpenTransaction()
+	if err != nil {
+		return nil, storageError(err)
+	}
+
+	return &levelDBTransaction{tr: tr, batch: new(leveldb.Batch)}, nil
+}
+
+// batchSize is how many bytes of saves a levelDBTransaction gathers before writing them.
+const batchSize = 1 << 20
+
+// levelDBTransaction is a Transaction on a LevelDB database. Saves are gathered into
+// batches, which are written whenever they grow large or anything else is done.
+type levelDBTransaction struct {
+	tr      *leveldb.Transaction
+	batch   *leveldb.Batch
+	pending int
+}
+
+// flush writes the saves that have been gathered so far.
+func (t *levelDBTransaction) flush() error {
+	if t.batch.Len() == 0 {
+		return nil
+	}
+	err := t.tr.Write(t.batch, nil)
+	t.batch.Reset()
+	t.pending = 0
+	return storageError(err)
+}
+
+func (t *levelDBTransaction) Exists(identifier []byte) (bool, error) {
+	if err := t.flush(); err != nil {
+		return false, err
+	}
+	exists, err := t.tr.Has(identifier, nil)
+	return exists, storageError(err)
+}
+
+func (t *levelDBTransaction) Save(identifier, ciphertext []byte) error {
+	t.batch.Put(identifier, ciphertext)
+	t.pending += len(identifier) + len(ciphertext)
+	if t.pending < batchSize {
+		return nil
+	}
+	return t.flush()
+}
+
+func (t *levelDBTransaction) Retrieve(identifier []byte) ([]byte, error) {
+	if err := t.flush(); err != nil {
+		return nil, err
+	}
+	data, err := t.tr.Get(identifier, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+
+	return data, storageError(err)
+}
+
+func (t *levelDBTransaction) Delete(identifier []byte) error {
+	if err := t.flush(); err != nil {
+		return err
+	}
+	return storageError(t.tr.Delete(identifier, nil))
+}
+
+func (t *levelDBTransaction) Commit() error {
+	if err := t.flush(); err != nil {
+		return err
+	}
+	return storageError(t.tr.Commit())
+}
+
+func (t *levelDBTransaction) Discard() {
+	t.tr.Discard()
+}
@@ -0,0 +1,325 @@
+package coffer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenLevelDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dissident")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "removable", "coffer")
+
+	// Opening a coffer that does not exist must not create anything.
+	if _, err := OpenLevelDB(path, false); err == nil {
+		t.Error("Expected an error opening a missing coffer")
+	}
+	if _, err := os.Stat(filepath.Dir(path)); !os.IsNotExist(err) {
+		t.Error("Opening a missing coffer created its parent directory")
+	}
+
+	// Explicitly create it.
+	l, err := OpenLevelDB(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Save([]byte("identifier"), []byte("ciphertext"))
+	l.Close()
+
+	// It can now be reopened.
+	l, err = OpenLevelDB(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if !bytes.Equal(retrieve(t, l, "identifier"), []byte("ciphertext")) {
+		t.Error("Retrieved value != saved value")
+	}
+	l.Delete([]byte("identifier"))
+
+	testWalk(t, l)
+}
+
+func TestOpenLevelDBReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dissident")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "coffer")
+	if _, err := OpenLevelDBReadOnly(path); err == nil {
+		t.Error("Expected an error opening a missing coffer")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("Opening a missing coffer read-only created it")
+	}
+	l, err := OpenLevelDB(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Save([]byte("identifier"), []byte("ciphertext"))
+	l.Close()
+	before, _ := ioutil.ReadDir(path)
+
+	// It can be read, but nothing can be written, and no file is touched.
+	if l, err = OpenLevelDBReadOnly(path); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(retrieve(t, l, "identifier"), []byte("ciphertext")) {
+		t.Error("Retrieved value != saved value")
+	}
+	if err := l.Save([]byte("other"), []byte("ciphertext")); err == nil {
+		t.Error("Expected saving to a read-only coffer to fail")
+	}
+	l.Close()
+	after, _ := ioutil.ReadDir(path)
+	if len(before) != len(after) {
+		t.Fatal("Expected", len(before), "files; found", len(after))
+	}
+	for i := range before {
+		if before[i].Name() != after[i].Name() || before[i].Size() != after[i].Size() || !before[i].ModTime().Equal(after[i].ModTime()) {
+			t.Error("File", before[i].Name(), "was changed")
+		}
+	}
+}
+
+func TestLevelDBTransaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dissident")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "coffer")
+	l, err := OpenLevelDB(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := l.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Save([]byte("committed"), []byte("value"))
+
+	// Saves are batched, but must be visible to the transaction straight away.
+	if data, err := tx.Retrieve([]byte("committed")); err != nil || !bytes.Equal(data, []byte("value")) {
+		t.Error("Expected to retrieve saved value; got", data, err)
+	}
+	large := make([]byte, batchSize/4)
+	for i := 0; i < 5; i++ {
+		tx.Save([]byte{byte(i)}, large)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if !exists(t, l, string([]byte{byte(i)})) {
+			t.Error("Batched entry", i, "is missing")
+		}
+	}
+
+	// Closing with an open transaction must discard it.
+	tx, err = l.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Save([]byte("interrupted"), []byte("value"))
+	l.Close()
+
+	l, err = OpenLevelDB(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if !exists(t, l, "committed") {
+		t.Error("Committed entry is missing")
+	}
+	if exists(t, l, "interrupted") {
+		t.Error("Uncommitted entry was applied")
+	}
+}
+
+func TestLevelDBErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dissident")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := OpenLevelDB(filepath.Join(dir, "coffer"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	// Everything fails once the database is closed.
+	if err := l.Save([]byte("identifier"), []byte("ciphertext")); !errors.Is(err, ErrStorage) {
+		t.Error("Expected ErrStorage; got", err)
+	}
+	if _, err := l.Retrieve([]byte("identifier")); !errors.Is(err, ErrStorage) {
+		t.Error("Expected ErrStorage; got", err)
+	}
+}
+
+// onDisk reports whether value is found in any file in the directory at path.
+func onDisk(t *testing.T, path string, value []byte) bool {
+	found := false
+	filepath.Walk(path, func(name string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			contents, _ := ioutil.ReadFile(name)
+			found = found || bytes.Contains(contents, value)
+		}
+		return nil
+	})
+	return found
+}
+
+func TestLevelDBShred(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dissident")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "coffer")
+	l, err := OpenLevelDB(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, removed := make([]byte, 4096), make([]byte, 4096)
+	rand.Read(kept)
+	rand.Read(removed)
+	l.Save([]byte("kept"), kept)
+	l.Save([]byte("removed"), removed)
+	l.Compact()
+
+	// Deleting leaves the value on disk until the database is compacted.
+	l.Delete([]byte("removed"))
+	if !onDisk(t, path, removed) {
+		t.Fatal("Expected the deleted value to still be on disk")
+	}
+
+	// Link to every file, to see what happens to them once they are removed.
+	links := filepath.Join(dir, "links")
+	os.Mkdir(links, 0700)
+	files, _ := ioutil.ReadDir(path)
+	for _, file := range files {
+		os.Link(filepath.Join(path, file.Name()), filepath.Join(links, file.Name()))
+	}
+
+	if err := l.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if onDisk(t, path, removed) || onDisk(t, links, removed) {
+		t.Error("Deleted value is still on disk after compacting")
+	}
+	os.RemoveAll(links)
+	l.Close()
+
+	// Rewriting keeps everything else.
+	if err := RewriteLevelDB(path); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 1 {
+		t.Error("Expected the old database to be removed; found", len(entries), "entries")
+	}
+	if l, err = OpenLevelDB(path, false); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if !bytes.Equal(retrieve(t, l, "kept"), kept) || exists(t, l, "removed") {
+		t.Error("Rewritten database doesn't hold the same values")
+	}
+}
+
+func TestFinishRewrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dissident")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// create makes a database at path holding value.
+	path := filepath.Join(dir, "coffer")
+	create := func(path, value string) {
+		l, err := OpenLevelDB(path, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Save([]byte("value"), []byte(value))
+		l.Close()
+	}
+	// check opens the database at path, checks it holds value, and that nothing is
+	// left beside it.
+	check := func(value string) {
+		t.Helper()
+		l, err := OpenLevelDB(path, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		if got := retrieve(t, l, "value"); string(got) != value {
+			t.Errorf("Expected %q; got %q", value, got)
+		}
+		if entries, _ := ioutil.ReadDir(dir); len(entries) != 1 {
+			t.Error("Expected only the database to be left; found", len(entries), "entries")
+		}
+	}
+
+	// Without the marker, whatever is beside the database is left alone, and gets in
+	// the way of rewriting it.
+	create(path, "old")
+	create(path+".new", "unrelated")
+	os.Mkdir(path+".old", 0700)
+	ioutil.WriteFile(filepath.Join(path+".old", "notes.txt"), []byte("notes"), 0600)
+	if l, err := OpenLevelDB(path, false); err != nil {
+		t.Fatal(err)
+	} else if got := retrieve(t, l, "value"); string(got) != "old" {
+		t.Errorf("Expected %q; got %q", "old", got)
+	} else {
+		l.Close()
+	}
+	if _, err := os.Stat(filepath.Join(path+".old", "notes.txt")); err != nil {
+		t.Error("Expected an unrelated file to be left alone; got", err)
+	}
+	if err := RewriteLevelDB(path); err == nil {
+		t.Error("Expected rewriting to refuse to touch what is in the way")
+	}
+	os.RemoveAll(path + ".new")
+	os.RemoveAll(path + ".old")
+
+	// mark leaves the marker of a rewrite that was interrupted.
+	mark := func() { ioutil.WriteFile(path+".rewriting", nil, 0600) }
+
+	// Interrupted while copying: the copy is thrown away.
+	create(path+".rewrite", "partial")
+	mark()
+	check("old")
+
+	// Interrupted once the copy was complete: it is swapped in.
+	create(path+".new", "new")
+	mark()
+	check("new")
+
+	// Interrupted after moving the old database out of the way.
+	os.Rename(path, path+".old")
+	create(path+".new", "newer")
+	mark()
+	check("newer")
+
+	// Interrupted while shredding the old database.
+	create(path+".old", "new")
+	mark()
+	check("newer")
+}
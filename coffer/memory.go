@@ -0,0 +1,185 @@
+package coffer
+
+import (
+	"errors"
+	"sync"
+)
+
+// errTransactionDone is returned when a finished transaction is used.
+var errTransactionDone = storageError(errors.New("transaction already closed"))
+
+// Memory is a Backend that keeps the coffer in memory. Nothing is persisted, so
+// it is mainly useful for testing and for short-lived scratch coffers.
+type Memory struct {
+	sync.RWMutex
+	entries map[string][]byte
+}
+
+// NewMemory returns an empty in-memory coffer.
+func NewMemory() *Memory {
+	return &Memory{entries: make(map[string][]byte)}
+}
+
+// Exists checks if an entry exists and returns true or false.
+func (m *Memory) Exists(identifier []byte) (bool, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	_, ok := m.entries[string(identifier)]
+	return ok, nil
+}
+
+// Save saves a copy of a secret.
+func (m *Memory) Save(identifier, ciphertext []byte) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.entries[string(identifier)] = append([]byte{}, ciphertext...)
+	return nil
+}
+
+// Retrieve retrieves a copy of a secret.
+func (m *Memory) Retrieve(identifier []byte) ([]byte, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	data, ok := m.entries[string(identifier)]
+	if !ok {
+		return nil, nil
+	}
+
+	return append([]byte{}, data...), nil
+}
+
+// Delete deletes an entry.
+func (m *Memory) Delete(identifier []byte) error {
+	m.Lock()
+	defer m.Unlock()
+
+	delete(m.entries, string(identifier))
+	return nil
+}
+
+// Walk calls fn with every entry held. The entries are gathered first, so fn may change
+// the coffer.
+func (m *Memory) Walk(fn func(identifier, ciphertext []byte) error) error {
+	m.RLock()
+	entries := make(map[string][]byte, len(m.entries))
+	for identifier, ciphertext := range m.entries {
+		entries[identifier] = ciphertext
+	}
+	m.RUnlock()
+
+	for identifier, ciphertext := range entries {
+		if err := fn([]byte(identifier), append([]byte{}, ciphertext...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Len returns the number of entries held.
+func (m *Memory) Len() int {
+	m.RLock()
+	defer m.RUnlock()
+
+	return len(m.entries)
+}
+
+// Close discards every entry.
+func (m *Memory) Close() error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.entries = make(map[string][]byte)
+	return nil
+}
+
+// Begin starts a transaction. Writes are buffered until they are committed.
+func (m *Memory) Begin() (Transaction, error) {
+	return &memoryTransaction{m: m, pending: make(map[string][]byte)}, nil
+}
+
+// memoryTransaction buffers writes to a Memory coffer. A nil value in pending
+// marks a deletion.
+type memoryTransaction struct {
+	sync.Mutex
+	m       *Memory
+	pending map[string][]byte
+	done    bool
+}
+
+func (t *memoryTransaction) Exists(identifier []byte) (bool, error) {
+	data, err := t.Retrieve(identifier)
+	return data != nil, err
+}
+
+func (t *memoryTransaction) Save(identifier, ciphertext []byte) error {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.done {
+		return errTransactionDone
+	}
+
+	t.pending[string(identifier)] = append([]byte{}, ciphertext...)
+	return nil
+}
+
+func (t *memoryTransaction) Retrieve(identifier []byte) ([]byte, error) {
+	t.Lock()
+	data, ok := t.pending[string(identifier)]
+	t.Unlock()
+
+	if !ok {
+		return t.m.Retrieve(identifier)
+	}
+	if data == nil {
+		return nil, nil
+	}
+
+	return append([]byte{}, data...), nil
+}
+
+func (t *memoryTransaction) Delete(identifier []byte) error {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.done {
+		return errTransactionDone
+	}
+
+	t.pending[string(identifier)] = nil
+	return nil
+}
+
+func (t *memoryTransaction) Commit() error {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.done {
+		return errTransactionDone
+	}
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	for identifier, data := range t.pending {
+		if data == nil {
+			delete(t.m.entries, identifier)
+		} else {
+			t.m.entries[identifier] = data
+		}
+	}
+	t.done = true
+
+	return nil
+}
+
+func (t *memoryTransaction) Discard() {
+	t.Lock()
+	defer t.Unlock()
+
+	t.pending = nil
+	t.done = true
+}
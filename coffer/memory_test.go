@@ -0,0 +1,130 @@
+package coffer
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// exists is Store.Exists for tests, failing on error.
+func exists(t *testing.T, s Store, identifier string) bool {
+	exists, err := s.Exists([]byte(identifier))
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	return exists
+}
+
+// retrieve is Store.Retrieve for tests, failing on error.
+func retrieve(t *testing.T, s Store, identifier string) []byte {
+	data, err := s.Retrieve([]byte(identifier))
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	return data
+}
+
+func TestMemory(t *testing.T) {
+	m := NewMemory()
+	defer m.Close()
+
+	ciphertext := []byte("ciphertext")
+
+	if exists(t, m, "identifier") {
+		t.Error("Expected entry to not exist")
+	}
+	if retrieve(t, m, "identifier") != nil {
+		t.Error("Expected nil for missing entry")
+	}
+
+	m.Save([]byte("identifier"), ciphertext)
+	if !exists(t, m, "identifier") {
+		t.Error("Expected entry to exist")
+	}
+	if !bytes.Equal(retrieve(t, m, "identifier"), ciphertext) {
+		t.Error("Retrieved value != saved value")
+	}
+
+	// Modifying the caller's slice must not affect the stored copy.
+	ciphertext[0] = 'C'
+	if bytes.Equal(retrieve(t, m, "identifier"), ciphertext) {
+		t.Error("Stored value shares memory with the caller")
+	}
+
+	m.Delete([]byte("identifier"))
+	if exists(t, m, "identifier") || m.Len() != 0 {
+		t.Error("Expected entry to be deleted")
+	}
+
+	testWalk(t, m)
+}
+
+// testWalk checks that b walks over everything in it, even while it is being changed.
+func testWalk(t *testing.T, b Backend) {
+	for _, identifier := range []string{"a", "b", "c"} {
+		b.Save([]byte(identifier), []byte("value"))
+	}
+
+	walked := make(map[string]bool)
+	err := b.Walk(func(identifier, ciphertext []byte) error {
+		walked[string(identifier)] = string(ciphertext) == "value"
+		return b.Delete(identifier)
+	})
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if len(walked) != 3 || !walked["a"] || !walked["b"] || !walked["c"] {
+		t.Error("Expected to walk over a, b and c; got", walked)
+	}
+	if exists(t, b, "a") || exists(t, b, "b") || exists(t, b, "c") {
+		t.Error("Expected everything walked over to be deleted")
+	}
+
+	// Errors stop the walk.
+	b.Save([]byte("a"), []byte("value"))
+	failure := errors.New("failed")
+	if err := b.Walk(func(_, _ []byte) error { return failure }); err != failure {
+		t.Error("Expected walk to fail; got", err)
+	}
+	b.Delete([]byte("a"))
+}
+
+func TestMemoryTransaction(t *testing.T) {
+	m := NewMemory()
+	defer m.Close()
+
+	m.Save([]byte("old"), []byte("value"))
+
+	tx, err := m.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Save([]byte("new"), []byte("value"))
+	tx.Delete([]byte("old"))
+
+	// The transaction sees its own writes but nobody else does.
+	if !exists(t, tx, "new") || exists(t, tx, "old") {
+		t.Error("Transaction does not see its own writes")
+	}
+	if exists(t, m, "new") || !exists(t, m, "old") {
+		t.Error("Uncommitted writes are visible")
+	}
+
+	tx.Discard()
+	if exists(t, m, "new") || !exists(t, m, "old") {
+		t.Error("Discarded writes were applied")
+	}
+	if tx.Commit() == nil {
+		t.Error("Expected an error committing a discarded transaction")
+	}
+
+	tx, _ = m.Begin()
+	tx.Save([]byte("new"), []byte("value"))
+	tx.Delete([]byte("old"))
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if !exists(t, m, "new") || exists(t, m, "old") {
+		t.Error("Committed writes were not applied")
+	}
+}
@@ -0,0 +1,85 @@
+package coffer
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// ErrInvalidParams is returned when a vault's parameters can't be read.
+var ErrInvalidParams = errors.New("! Invalid vault parameters; database may be corrupt")
+
+// ParamsKey is where a vault's parameters are kept. It is shorter than the 32 byte
+// identifiers that chunks are stored under, so it can never collide with one.
+var ParamsKey = []byte("dissident.params")
+
+// Params are the settings a vault is created with. Unlike everything else in a coffer
+// they are stored in the clear, and every vault has them whether or not it holds any
+// data, so they give nothing away.
+type Params struct {
+	// Salt is mixed into key derivation, so that keys derived for one vault are of no
+	// use against any other.
+	Salt []byte `json:"salt"`
+
+	// KDF specifies how keys are derived, in the form crypto.ParseKDF accepts. Vaults
+	// that don't record one use crypto.DefaultKDF.
+	KDF string `json:"kdf,omitempty"`
+
+	// Hierarchy is set on vaults that stretch the master password alone into a root
+	// secret, and derive the keys for each identifier from that.
+	Hierarchy bool `json:"hierarchy,omitempty"`
+
+	// Suite names the cipher suite every chunk is encrypted with, in the form
+	// crypto.ParseSuite accepts. Vaults that don't record one use XSalsa20-Poly1305.
+	Suite string `json:"suite,omitempty"`
+
+	// ChunkSize is how many bytes every chunk, decoys included, is padded to before it
+	// is encrypted. Vaults that don't record one use 4096.
+	ChunkSize int `json:"chunksize,omitempty"`
+
+	// Decoys is set on constant-size vaults to the KDF that decoy keys are derived with,
+	// in the form crypto.ParseKDF accepts. Unlike KDF it never changes, so that decoys
+	// added before the KDF changed can still be evicted.
+	Decoys string `json:"decoys,omitempty"`
+
+	// Previous lists the ways keys were derived before the KDF last changed, most
+	// recent first, since entries stored then may still be there. Vaults created before
+	// salts were introduced start out with an unsalted derivation here.
+	Previous []Derivation `json:"previous,omitempty"`
+}
+
+// Derivation is one way of deriving keys: a salt, which may be empty, a KDF, and
+// whether the key hierarchy is used.
+type Derivation struct {
+	Salt      []byte `json:"salt,omitempty"`
+	KDF       string `json:"kdf"`
+	Hierarchy bool   `json:"hierarchy,omitempty"`
+}
+
+// Current returns the way keys are derived now.
+func (p *Params) Current() Derivation {
+	return Derivation{Salt: p.Salt, KDF: p.KDF, Hierarchy: p.Hierarchy}
+}
+
+// LoadParams reads a vault's parameters, returning nil if it doesn't have any.
+func LoadParams(s Store) (*Params, error) {
+	value, err := s.Retrieve(ParamsKey)
+	if err != nil || value == nil {
+		return nil, err
+	}
+
+	params := new(Params)
+	if err := json.Unmarshal(value, params); err != nil || len(params.Salt) == 0 {
+		return nil, ErrInvalidParams
+	}
+	return params, nil
+}
+
+// SaveParams writes a vault's parameters.
+func SaveParams(s Store, params *Params) error {
+	value, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+
+	return s.Save(ParamsKey, value)
+}
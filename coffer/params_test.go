@@ -0,0 +1,30 @@
+package coffer
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParams(t *testing.T) {
+	s := NewMemory()
+
+	if params, err := LoadParams(s); err != nil || params != nil {
+		t.Error("Expected no parameters;", params, err)
+	}
+
+	if err := SaveParams(s, &Params{Salt: []byte("salt"), Previous: []Derivation{{KDF: "scrypt"}}}); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	params, err := LoadParams(s)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if !bytes.Equal(params.Salt, []byte("salt")) || len(params.Previous) != 1 || params.Previous[0].Salt != nil {
+		t.Errorf("Unexpected parameters: %+v", params)
+	}
+
+	s.Save(ParamsKey, []byte("{"))
+	if _, err := LoadParams(s); err != ErrInvalidParams {
+		t.Error("Expected ErrInvalidParams; got", err)
+	}
+}
@@ -0,0 +1,76 @@
+package coffer
+
+import (
+	"crypto/rand"
+	"os"
+	"path/filepath"
+
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+// Compacter is implemented by backends that keep deleted values on disk until they are
+// compacted away.
+type Compacter interface {
+	// Compact drops deleted values from storage, overwriting the files that held them.
+	Compact() error
+}
+
+// shreddingStorage is LevelDB's file storage, but overwrites files before removing them.
+// LevelDB never changes a file once it is written, so a value is only gone once every
+// table and journal that held it has been removed.
+type shreddingStorage struct {
+	storage.Storage
+	path string
+}
+
+// Remove overwrites a file with random bytes, then removes it.
+func (s *shreddingStorage) Remove(fd storage.FileDesc) error {
+	if err := shredFile(filepath.Join(s.path, fd.String())); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return s.Storage.Remove(fd)
+}
+
+// shredFile overwrites the file at path with random bytes and waits for them to reach
+// the disk. Filesystems that copy on write, and drives that remap sectors, may still
+// keep the old contents somewhere.
+func shredFile(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 1<<20)
+	for written := int64(0); written < info.Size(); written += int64(len(buf)) {
+		if info.Size()-written < int64(len(buf)) {
+			buf = buf[:info.Size()-written]
+		}
+		if _, err := rand.Read(buf); err != nil {
+			return err
+		}
+		if _, err := file.WriteAt(buf, written); err != nil {
+			return err
+		}
+	}
+
+	return file.Sync()
+}
+
+// shredDir shreds and removes every file in the directory at path, then the directory.
+func shredDir(path string) error {
+	err := filepath.Walk(path, func(name string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		return shredFile(name)
+	})
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(path)
+}
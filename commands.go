@@ -0,0 +1,461 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/awnumar/dissident/coffer"
+	"github.com/awnumar/dissident/crypto"
+	"github.com/awnumar/dissident/data"
+	"github.com/awnumar/dissident/stdin"
+	"github.com/awnumar/dissident/vault"
+	"github.com/awnumar/memguard"
+)
+
+// Exit codes returned by non-interactive subcommands.
+const (
+	exitOK       = 0 // Everything went well.
+	exitFailure  = 1 // Something went wrong.
+	exitUsage    = 2 // The command line was invalid.
+	exitNotFound = 3 // The requested entry does not exist.
+
+	exitInterrupted = 130 // A signal stopped the program.
+)
+
+// errUsage is returned by a subcommand when it was invoked incorrectly.
+var errUsage = errors.New("! Invalid usage")
+
+// command is a non-interactive subcommand.
+type command struct {
+	usage   string
+	summary string
+	run     func(flags *flag.FlagSet, args []string) error
+}
+
+// commands maps the name of each subcommand to its implementation.
+var commands = map[string]command{
+	"import":      {"[options] <path>", "Import a new file or directory to the database; - reads standard input.", importCommand},
+	"export":      {"[options] <path>", "Retrieve data from the database and export to a file or directory; - writes standard output.", exportCommand},
+	"cat":         {"[options]", "Write data from the database to standard output.", catCommand},
+	"verify":      {"[options]", "Check that every chunk of an entry decrypts, without writing anything.", verifyCommand},
+	"rm":          {"[options]", "Remove some previously stored data from the database.", rmCommand},
+	"migrate":     {"[options]", "Re-encrypt an entry stored by an older version or under a previous salt or KDF.", migrateCommand},
+	"decoys":      {"-n <count>", "Add the given number of random decoys; constant-size vaults also need the master password.", decoysCommand},
+	"calibrate":   {"[options]", "Measure what the KDF costs on this machine and recommend settings for it.", calibrateCommand},
+	"shred-vault": {"", "Rewrite the database in a random order and shred the files it was in.", shredVaultCommand},
+	"stats":       {"", "Count the values in the database and their sizes; needs no password.", statsCommand},
+	"fsck":        {"", "Look for values the database couldn't have written; needs no password.", fsckCommand},
+}
+
+// readOnly lists the subcommands that only inspect the vault, which is then opened
+// without changing anything in it. calibrate reopens it to save what it recommends.
+var readOnly = map[string]bool{"stats": true, "fsck": true, "calibrate": true}
+
+// usage prints help for the whole program.
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [--vault <path>] [--create] [command [options] [arguments]]\n\n", os.Args[0])
+	fmt.Fprintln(out, "Without a command, an interactive session is started.\n\nCommands:")
+	for _, name := range []string{"import", "export", "cat", "verify", "rm", "migrate", "decoys", "calibrate", "shred-vault", "stats", "fsck"} {
+		fmt.Fprintf(out, "  %-11s %s\n", name, commands[name].summary)
+	}
+	fmt.Fprintln(out, "\nGlobal options:")
+	flag.PrintDefaults()
+}
+
+// runCommand runs a single, known, subcommand and returns the exit code.
+func runCommand(args []string) int {
+	cmd := commands[args[0]]
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s %s %s\n\n%s\n\nOptions:\n", os.Args[0], args[0], cmd.usage, cmd.summary)
+		flags.PrintDefaults()
+	}
+
+	switch err := cmd.run(flags, args[1:]); err {
+	case nil, flag.ErrHelp:
+		return exitOK
+	case errUsage:
+		return exitUsage
+	case data.ErrEntryNotFound:
+		fmt.Fprintln(os.Stderr, err)
+		return exitNotFound
+	default:
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+}
+
+// parse parses the options of a subcommand and checks that it was given nargs
+// arguments. Problems are reported to the user and errUsage is returned.
+func parse(flags *flag.FlagSet, args []string, nargs int) error {
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return err
+		}
+		return errUsage
+	}
+
+	if flags.NArg() != nargs {
+		flags.Usage()
+		return errUsage
+	}
+
+	return nil
+}
+
+// secrets knows where to get the master password and identifier from. Secrets are
+// never accepted on the command line itself, where other users could see them.
+type secrets struct {
+	passwordFD     int
+	passwordFile   string
+	identifierFD   int
+	identifierFile string
+	askpass        string
+}
+
+// newSecrets registers the options for supplying secrets with flags.
+func newSecrets(flags *flag.FlagSet) *secrets {
+	s := new(secrets)
+	flags.IntVar(&s.passwordFD, "password-fd", -1, "read the master password from this file descriptor")
+	flags.StringVar(&s.passwordFile, "password-file", "", "read the master password from the first line of this file")
+	flags.IntVar(&s.identifierFD, "identifier-fd", -1, "read the identifier from this file descriptor")
+	flags.StringVar(&s.identifierFile, "identifier-file", "", "read the identifier from the first line of this file")
+	flags.StringVar(&s.askpass, "askpass", os.Getenv("DISSIDENT_ASKPASS"), "program to run to ask for secrets (default $DISSIDENT_ASKPASS)")
+	return s
+}
+
+// get fetches a secret from the first source that is configured, falling back to
+// prompting on the terminal. The name of the secret is used in error messages.
+func (s *secrets) get(fd int, file, name, prompt string, confirm bool) (*memguard.LockedBuffer, error) {
+	switch {
+	case fd >= 0:
+		return stdin.FromFD(fd)
+	case file != "":
+		return stdin.FromFile(file)
+	case s.askpass != "":
+		return stdin.Askpass(s.askpass, prompt)
+	case stdin.HasTerminal():
+		if confirm {
+			return stdin.GetMasterPassword(), nil
+		}
+		return stdin.Secure(prompt), nil
+	}
+
+	return nil, fmt.Errorf("! No terminal to prompt on; use --%s-fd, --%s-file or --askpass", name, name)
+}
+
+// session reads the master password and starts a session with it. The password is
+// confirmed when prompting for it on the terminal if confirm is true.
+func (s *secrets) session(confirm bool) (*vault.Session, error) {
+	password, err := s.get(s.passwordFD, s.passwordFile, "password", "- Master password: ", confirm)
+	if err != nil {
+		return nil, err
+	}
+	if password, err = withKeyfiles(password); err != nil {
+		return nil, err
+	}
+	defer password.Destroy()
+
+	return store.Session(password)
+}
+
+// entry reads the secrets and derives the keys for their entry. The master password is
+// confirmed when prompting for it on the terminal if confirm is true.
+func (s *secrets) entry(confirm bool) (*vault.Entry, error) {
+	session, err := s.session(confirm)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Destroy()
+
+	identifier, err := s.get(s.identifierFD, s.identifierFile, "identifier", "- Secure identifier: ", false)
+	if err != nil {
+		return nil, err
+	}
+	defer identifier.Destroy()
+
+	return session.Entry(identifier)
+}
+
+func importCommand(flags *flag.FlagSet, args []string) error {
+	s := newSecrets(flags)
+	if err := parse(flags, args, 1); err != nil {
+		return err
+	}
+	path := flags.Arg(0)
+
+	// Read from standard input if asked to, in which case the length is unknown
+	// until we reach the end.
+	f := os.Stdin
+	var info os.FileInfo
+	if path != "-" {
+		var err error
+		if f, err = os.Open(path); err != nil {
+			return err
+		}
+		defer f.Close()
+
+		if info, err = f.Stat(); err != nil {
+			return err
+		}
+	}
+
+	entry, err := s.entry(true)
+	if err != nil {
+		return err
+	}
+	defer entry.Destroy()
+
+	switch {
+	case info == nil:
+		return entry.Put(context.Background(), f)
+	case info.IsDir():
+		// Directories are stored as a single tar stream.
+		return entry.PutDirectory(context.Background(), path)
+	default:
+		return entry.PutFile(context.Background(), f, info)
+	}
+}
+
+func exportCommand(flags *flag.FlagSet, args []string) error {
+	s := newSecrets(flags)
+	if err := parse(flags, args, 1); err != nil {
+		return err
+	}
+	path := flags.Arg(0)
+
+	entry, err := s.entry(false)
+	if err != nil {
+		return err
+	}
+	defer entry.Destroy()
+
+	// Make sure there's something to export before creating the file.
+	meta, err := entry.Metadata()
+	if err != nil {
+		return err
+	}
+
+	// Write raw plaintext to standard output if asked to. Directories come out as
+	// the tar stream they are stored as.
+	if path == "-" {
+		return entry.Get(context.Background(), os.Stdout)
+	}
+
+	// Otherwise rebuild directories in place.
+	path = exportTarget(path, meta)
+	if meta.Directory {
+		return entry.GetDirectory(context.Background(), path)
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = entry.Get(context.Background(), f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return vault.Restore(path, meta)
+}
+
+func catCommand(flags *flag.FlagSet, args []string) error {
+	s := newSecrets(flags)
+	if err := parse(flags, args, 0); err != nil {
+		return err
+	}
+
+	entry, err := s.entry(false)
+	if err != nil {
+		return err
+	}
+	defer entry.Destroy()
+
+	return entry.Get(context.Background(), os.Stdout)
+}
+
+func verifyCommand(flags *flag.FlagSet, args []string) error {
+	s := newSecrets(flags)
+	if err := parse(flags, args, 0); err != nil {
+		return err
+	}
+
+	entry, err := s.entry(false)
+	if err != nil {
+		return err
+	}
+	defer entry.Destroy()
+
+	return verifyEntry(entry)
+}
+
+func rmCommand(flags *flag.FlagSet, args []string) error {
+	s := newSecrets(flags)
+	if err := parse(flags, args, 0); err != nil {
+		return err
+	}
+
+	entry, err := s.entry(false)
+	if err != nil {
+		return err
+	}
+	defer entry.Destroy()
+
+	return entry.Delete()
+}
+
+func migrateCommand(flags *flag.FlagSet, args []string) error {
+	s := newSecrets(flags)
+	if err := parse(flags, args, 0); err != nil {
+		return err
+	}
+
+	entry, err := s.entry(false)
+	if err != nil {
+		return err
+	}
+	defer entry.Destroy()
+
+	return entry.Migrate()
+}
+
+func shredVaultCommand(flags *flag.FlagSet, args []string) error {
+	if err := parse(flags, args, 0); err != nil {
+		return err
+	}
+	if coffer.IsContainer(storePath) {
+		return errors.New("! Containers overwrite removed values in place and keep no record of the order they were written in")
+	}
+
+	// The database has to be closed while it is rewritten.
+	closeStore()
+	if err := coffer.RewriteLevelDB(storePath); err != nil {
+		return err
+	}
+	return openVault(storePath, func(string) bool { return false })
+}
+
+func statsCommand(flags *flag.FlagSet, args []string) error {
+	if err := parse(flags, args, 0); err != nil {
+		return err
+	}
+
+	stats, err := store.Stats()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("+ %d values taking up %d bytes.\n", stats.Values, stats.Bytes)
+	if len(stats.Sizes) == 0 || len(stats.Sizes) == 1 && stats.Sizes[stats.ValueSize] != 0 {
+		fmt.Printf("+ Every value is %d bytes, as expected.\n", stats.ValueSize)
+		return nil
+	}
+	fmt.Printf("! Not every value is %d bytes:\n", stats.ValueSize)
+	sizes := make([]int, 0, len(stats.Sizes))
+	for size := range stats.Sizes {
+		sizes = append(sizes, size)
+	}
+	sort.Ints(sizes)
+	for _, size := range sizes {
+		fmt.Printf("  %10d bytes: %d\n", size, stats.Sizes[size])
+	}
+	return nil
+}
+
+func fsckCommand(flags *flag.FlagSet, args []string) error {
+	if err := parse(flags, args, 0); err != nil {
+		return err
+	}
+
+	problems := 0
+	err := store.Check(func(p vault.Problem) {
+		fmt.Println(p)
+		problems++
+	})
+	if err != nil {
+		return err
+	}
+	if problems != 0 {
+		return fmt.Errorf("! Found %d malformed values", problems)
+	}
+	fmt.Println("+ No problems found.")
+	return nil
+}
+
+func decoysCommand(flags *flag.FlagSet, args []string) error {
+	n := flags.Int("n", 0, "number of decoys to add")
+	s := newSecrets(flags)
+	if err := parse(flags, args, 0); err != nil {
+		return err
+	}
+
+	if *n < 0 {
+		flags.Usage()
+		return errUsage
+	}
+
+	// Decoys in constant-size vaults belong to a master password.
+	if !store.ConstantSize() {
+		return store.AddDecoys(*n)
+	}
+	session, err := s.session(true)
+	if err != nil {
+		return err
+	}
+	defer session.Destroy()
+
+	return session.AddDecoys(*n)
+}
+
+func calibrateCommand(flags *flag.FlagSet, args []string) error {
+	name := flags.String("kdf", "", "KDF to calibrate, scrypt or argon2id (default the vault's)")
+	target := flags.Duration("target", time.Second, "longest that deriving the keys for an entry may take")
+	maxMemory := flags.Uint64("max-memory", 1024, "most memory, in MiB, that deriving the keys for an entry may allocate")
+	save := flags.Bool("save", false, "derive keys with the recommended settings in this vault from now on")
+	if err := parse(flags, args, 0); err != nil {
+		return err
+	}
+	if *name == "" {
+		*name = strings.SplitN(store.KDF().String(), ":", 2)[0]
+	}
+	if *name != "scrypt" && *name != "argon2id" {
+		flags.Usage()
+		return errUsage
+	}
+
+	fmt.Printf("+ Measuring %s against a target of %s...\n", *name, *target)
+	kdf, err := crypto.Calibrate(*name, *target, *maxMemory<<20, func(m crypto.Measurement) {
+		fmt.Printf("  %-32s %10s %8d MiB allocated\n", m.KDF, m.Time.Round(time.Millisecond), m.Allocated>>20)
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println("+ Recommended:", kdf)
+
+	if !*save {
+		return nil
+	}
+
+	// The vault was opened read-only in case nothing was to be saved.
+	closeStore()
+	options.ReadOnly = false
+	if err := openVault(storePath, func(string) bool { return false }); err != nil {
+		return err
+	}
+	if err := store.SetKDF(kdf); err != nil {
+		return err
+	}
+	fmt.Println("+ Saved. Entries stored before now are still found, but migrate them to use the new settings.")
+	return nil
+}
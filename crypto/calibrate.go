@@ -0,0 +1,124 @@
+package crypto
+
+import (
+	"runtime"
+	"time"
+
+	"github.com/awnumar/memguard"
+)
+
+// Measurement records what it cost to derive a pair of keys with a KDF on this machine.
+type Measurement struct {
+	KDF KDF
+
+	// Time is how long DeriveSecureValues took.
+	Time time.Duration
+
+	// Allocated is how many bytes were allocated while deriving. Not all of it need be
+	// in use at once, so it is at least as much as the most memory deriving needs.
+	Allocated uint64
+}
+
+// Measure times a single call to DeriveSecureValues with kdf.
+func Measure(kdf KDF) (Measurement, error) {
+	password, err := memguard.NewRandom(32, false)
+	if err != nil {
+		return Measurement{}, err
+	}
+	defer password.Destroy()
+	identifier, err := memguard.NewRandom(32, false)
+	if err != nil {
+		return Measurement{}, err
+	}
+	defer identifier.Destroy()
+	salt, err := GenerateRandomBytes(32)
+	if err != nil {
+		return Measurement{}, err
+	}
+
+	// Start from a clean heap so that earlier runs don't get in the way.
+	runtime.GC()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	start := time.Now()
+	masterKey, rootIdentifier, err := DeriveSecureValues(password, identifier, salt, kdf)
+	elapsed := time.Since(start)
+	if err != nil {
+		return Measurement{}, err
+	}
+	masterKey.Destroy()
+	rootIdentifier.Destroy()
+
+	runtime.ReadMemStats(&after)
+	return Measurement{KDF: kdf, Time: elapsed, Allocated: after.TotalAlloc - before.TotalAlloc}, nil
+}
+
+// Calibrate measures increasingly expensive settings of the named KDF, "scrypt" or
+// "argon2id", until one takes longer than target or allocates more than maxMemory bytes. It
+// returns the most expensive settings that stayed within both, or the cheapest ones
+// if none did. Each measurement is passed to report, if it isn't nil, as it is made.
+func Calibrate(name string, target time.Duration, maxMemory uint64, report func(Measurement)) (KDF, error) {
+	var kdf KDF
+	switch name {
+	case "scrypt":
+		kdf = Scrypt{LogN: 12, R: 16, P: 1}
+	case "argon2id":
+		kdf = Argon2id{Time: 3, Memory: 8 * 1024, Threads: 4}
+	default:
+		return nil, ErrInvalidKDF
+	}
+
+	var best KDF
+	for {
+		m, err := Measure(kdf)
+		if err != nil {
+			return nil, err
+		}
+		if report != nil {
+			report(m)
+		}
+		if m.Time > target || m.Allocated > maxMemory {
+			break
+		}
+		best = kdf
+
+		// Use more memory while we can, and more time once we can't.
+		var ok bool
+		if kdf, ok = harder(kdf, maxMemory); !ok {
+			break
+		}
+	}
+
+	if best == nil {
+		// Even the cheapest settings were too much; they are the best we can do.
+		return kdf, nil
+	}
+	return best, nil
+}
+
+// harder returns the next, more expensive, settings to try after kdf, or false if
+// there are none.
+func harder(kdf KDF, maxMemory uint64) (KDF, bool) {
+	switch k := kdf.(type) {
+	case Scrypt:
+		if 128*uint64(k.R)<<uint(k.LogN+1) <= maxMemory && k.LogN < maxScryptLogN {
+			k.LogN++
+			return k, true
+		}
+		if k.P < 64 {
+			k.P++
+			return k, true
+		}
+	case Argon2id:
+		if 2*1024*uint64(k.Memory) <= maxMemory && k.Memory < 1<<31 {
+			k.Memory *= 2
+			return k, true
+		}
+		if k.Time < 64 {
+			k.Time++
+			return k, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,62 @@
+package crypto
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMeasure(t *testing.T) {
+	m, err := Measure(Scrypt{LogN: 10, R: 8, P: 1})
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if m.Time <= 0 || m.Allocated < 128*8<<10 {
+		t.Errorf("Unexpected measurement: %+v", m)
+	}
+}
+
+func TestCalibrate(t *testing.T) {
+	// Stops at the memory limit, however much time is allowed.
+	kdf, err := Calibrate("scrypt", time.Hour, 16<<20, nil)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if kdf != (Scrypt{LogN: 12, R: 16, P: 1}) {
+		t.Error("Unexpected recommendation:", kdf)
+	}
+
+	// Recommends the cheapest settings if nothing is cheap enough.
+	var measured int
+	kdf, err = Calibrate("argon2id", 0, 1<<40, func(Measurement) { measured++ })
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if kdf != (Argon2id{Time: 3, Memory: 8 * 1024, Threads: 4}) || measured != 1 {
+		t.Error("Unexpected recommendation:", kdf, "after", measured, "measurements")
+	}
+
+	if _, err := Calibrate("bcrypt", time.Second, 1<<30, nil); err != ErrInvalidKDF {
+		t.Error("Expected ErrInvalidKDF; got", err)
+	}
+}
+
+func TestHarder(t *testing.T) {
+	// Memory grows until it would pass the limit, then time does.
+	kdf, _ := harder(Argon2id{Time: 3, Memory: 1024, Threads: 4}, 2<<20)
+	if kdf != (Argon2id{Time: 3, Memory: 2048, Threads: 4}) {
+		t.Error("Unexpected settings:", kdf)
+	}
+	kdf, _ = harder(kdf, 2<<20)
+	if kdf != (Argon2id{Time: 4, Memory: 2048, Threads: 4}) {
+		t.Error("Unexpected settings:", kdf)
+	}
+
+	kdf, _ = harder(Scrypt{LogN: 10, R: 8, P: 1}, 2<<20)
+	if kdf != (Scrypt{LogN: 11, R: 8, P: 1}) {
+		t.Error("Unexpected settings:", kdf)
+	}
+	kdf, _ = harder(kdf, 2<<20)
+	if kdf != (Scrypt{LogN: 11, R: 8, P: 2}) {
+		t.Error("Unexpected settings:", kdf)
+	}
+}
@@ -1,24 +1,17 @@
 package crypto
 
-import (
-	"crypto/rand"
-	"fmt"
-
-	"github.com/awnumar/memguard"
-)
+import "crypto/rand"
 
 // GenerateRandomBytes generates cryptographically secure random bytes.
-func GenerateRandomBytes(n int) []byte {
+func GenerateRandomBytes(n int) ([]byte, error) {
 	// Create a byte slice (b) of size n to store the random bytes.
 	b := make([]byte, n)
 
-	// Read n bytes into b; throw an error if number of bytes read != n.
-	_, err := rand.Read(b)
-	if err != nil {
-		fmt.Println(err)
-		memguard.SafeExit(1)
+	// Read n bytes into b; return an error if number of bytes read != n.
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
 	}
 
 	// Return the CSPR bytes.
-	return b
+	return b, nil
 }
@@ -3,7 +3,10 @@ package crypto
 import "testing"
 
 func TestGenerateRandomBytes(t *testing.T) {
-	randomBytes := GenerateRandomBytes(32)
+	randomBytes, err := GenerateRandomBytes(32)
+	if err != nil {
+		t.Error("Unexpected error:", err)
+	}
 	if randomBytes == nil {
 		t.Error("Returned bytes not random; got nil.")
 	}
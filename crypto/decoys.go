@@ -1,17 +1,26 @@
 package crypto
 
 import (
+	"crypto/subtle"
+
 	"github.com/awnumar/memguard"
 	"golang.org/x/crypto/blake2b"
 )
 
-// GenDecoy generates and returns a single decoy.
-func GenDecoy() (id, ct []byte) {
+// GenDecoy generates and returns a single decoy of size bytes, before encryption with
+// suite, so that it is the same size as every other chunk in the vault.
+func GenDecoy(suite Suite, size int) (id, ct []byte, err error) {
 	// Get some random bytes.
-	randomBytes := GenerateRandomBytes(64)
+	randomBytes, err := GenerateRandomBytes(64)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	// Allocate 32 bytes as the key.
-	key, _ := memguard.New(32, false)
+	key, err := memguard.New(32, false)
+	if err != nil {
+		return nil, nil, err
+	}
 	key.Copy(randomBytes[0:32])
 	defer key.Destroy()
 
@@ -19,13 +28,48 @@ func GenDecoy() (id, ct []byte) {
 	identifier := randomBytes[32:64]
 	hashedIdentifier := blake2b.Sum256(identifier)
 
-	// Allocate 32 bytes as the plaintext.
-	plaintext := make([]byte, 4096)
+	// Allocate a chunk's worth of plaintext.
+	plaintext := make([]byte, size)
 
 	// Encrypt/derive the final values.
-	id = hashedIdentifier[:]
-	ct = Encrypt(plaintext, key)
+	ct, err = suite.Encrypt(plaintext, key)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	// Return the decoy to the caller.
-	return
+	return hashedIdentifier[:], ct, nil
+}
+
+// GenOwnedDecoy is GenDecoy, but the decoy's identifier is marked with decoyKey so that
+// IsOwnedDecoy can pick it out again. Without the key, the mark looks as random as the
+// identifier of any other decoy or chunk.
+func GenOwnedDecoy(suite Suite, size int, decoyKey *memguard.LockedBuffer) (id, ct []byte, err error) {
+	_, ct, err = GenDecoy(suite, size)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Half of the identifier is random, and the other half marks it.
+	id, err = GenerateRandomBytes(16)
+	if err != nil {
+		return nil, nil, err
+	}
+	return append(id, decoyMark(decoyKey, id)...), ct, nil
+}
+
+// IsOwnedDecoy reports whether identifier was made by GenOwnedDecoy with decoyKey. Any
+// other identifier is only mistaken for one with negligible probability.
+func IsOwnedDecoy(decoyKey *memguard.LockedBuffer, identifier []byte) bool {
+	if len(identifier) != 32 {
+		return false
+	}
+	return subtle.ConstantTimeCompare(decoyMark(decoyKey, identifier[:16]), identifier[16:]) == 1
+}
+
+// decoyMark computes the second half of an owned decoy's identifier from the first.
+func decoyMark(decoyKey *memguard.LockedBuffer, random []byte) []byte {
+	h, _ := blake2b.New256(decoyKey.Buffer)
+	h.Write(random)
+	return h.Sum(nil)[:16]
 }
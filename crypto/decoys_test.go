@@ -1,9 +1,16 @@
 package crypto
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/awnumar/memguard"
+)
 
 func TestGenDecoy(t *testing.T) {
-	id, ct := GenDecoy()
+	id, ct, err := GenDecoy(XSalsa20Poly1305, 4096)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
 
 	// Check if they're the right length.
 
@@ -24,4 +31,41 @@ func TestGenDecoy(t *testing.T) {
 	if ct == nil {
 		t.Error("Ciphertext is nil.")
 	}
+
+	// Decoys are the size of a chunk in every suite.
+	for _, suite := range []Suite{XSalsa20Poly1305, XChaCha20Poly1305, AES256GCMSIV} {
+		if _, ct, err := GenDecoy(suite, 4096); err != nil || len(ct) != 4096+suite.Overhead() {
+			t.Error("! Ciphertext incorrect length for", suite, len(ct), err)
+		}
+	}
+
+	// And of every chunk size.
+	if _, ct, err := GenDecoy(XSalsa20Poly1305, 65536); err != nil || len(ct) != 65536+40 {
+		t.Error("! Ciphertext incorrect length for 64 KiB chunks:", len(ct), err)
+	}
+}
+
+func TestGenOwnedDecoy(t *testing.T) {
+	key, _ := memguard.NewRandom(32, false)
+	other, _ := memguard.NewRandom(32, false)
+
+	id, ct, err := GenOwnedDecoy(XSalsa20Poly1305, 4096, key)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if len(id) != 32 || len(ct) != 4136 {
+		t.Error("! Incorrect lengths:", len(id), len(ct))
+	}
+
+	// Only the key that made it recognises it.
+	if !IsOwnedDecoy(key, id) {
+		t.Error("Decoy was not recognised by its own key")
+	}
+	if IsOwnedDecoy(other, id) {
+		t.Error("Decoy was recognised by another key")
+	}
+	plain, _, _ := GenDecoy(XSalsa20Poly1305, 4096)
+	if IsOwnedDecoy(key, plain) || IsOwnedDecoy(key, id[:16]) {
+		t.Error("Other identifiers were taken for owned decoys")
+	}
 }
@@ -2,33 +2,31 @@ package crypto
 
 import (
 	"encoding/binary"
-	"fmt"
 	"runtime/debug"
 
 	"github.com/awnumar/memguard"
 	"golang.org/x/crypto/blake2b"
-	"golang.org/x/crypto/scrypt"
 )
 
-// DeriveSecureValues derives and returns a masterKey and rootIdentifier.
-func DeriveSecureValues(masterPassword, identifier *memguard.LockedBuffer, costFactor map[string]int) (*memguard.LockedBuffer, *memguard.LockedBuffer) {
+// DeriveSecureValues derives and returns a masterKey and rootIdentifier. The salt is
+// unique to each vault; vaults created before salts were introduced use an empty one.
+func DeriveSecureValues(masterPassword, identifier *memguard.LockedBuffer, salt []byte, kdf KDF) (*memguard.LockedBuffer, *memguard.LockedBuffer, error) {
 	// Allocate and protect memory for the concatenated values, and append the values to it.
 	concatenatedValues, err := memguard.Concatenate(masterPassword, identifier)
 	if err != nil {
-		fmt.Println(err)
-		memguard.SafeExit(1)
+		return nil, nil, err
 	}
 	defer concatenatedValues.Destroy()
 
 	// Derive the rootKey and then protect it.
-	rootKeySlice, _ := scrypt.Key(
-		concatenatedValues.Buffer, // Input data.
-		[]byte(""),                // Salt.
-		1<<uint(costFactor["N"]),  // Scrypt parameter N.
-		costFactor["r"],           // Scrypt parameter r.
-		costFactor["p"],           // Scrypt parameter p.
-		64)                        // Output hash length.
-	rootKey, _ := memguard.NewFromBytes(rootKeySlice, false)
+	rootKeySlice, err := kdf.Key(concatenatedValues.Buffer, salt, 64)
+	if err != nil {
+		return nil, nil, err
+	}
+	rootKey, err := memguard.NewFromBytes(rootKeySlice, false)
+	if err != nil {
+		return nil, nil, err
+	}
 	defer rootKey.Destroy()
 
 	// Force the Go GC to do its job.
@@ -37,12 +35,70 @@ func DeriveSecureValues(masterPassword, identifier *memguard.LockedBuffer, costF
 	// Get the respective values.
 	masterKey, rootIdentifier, err := memguard.Split(rootKey, 32)
 	if err != nil {
-		fmt.Println(err)
-		memguard.SafeExit(1)
+		return nil, nil, err
 	}
 
 	// Slice and return respective values.
-	return masterKey, rootIdentifier
+	return masterKey, rootIdentifier, nil
+}
+
+// Contexts that keep the two levels of the key hierarchy apart from each other, from
+// decoy keys and from DeriveSecureValues.
+const (
+	rootSecretContext = "dissident-root-v1"
+	entryKeyContext   = "dissident-entry-v1"
+	decoyKeyContext   = "dissident-decoys-v1"
+)
+
+// DeriveRootSecret stretches the master password alone into a root secret, from which
+// the values for each identifier are derived cheaply with DeriveEntryValues. It is as
+// expensive as DeriveSecureValues, but only has to be done once per session.
+func DeriveRootSecret(masterPassword *memguard.LockedBuffer, salt []byte, kdf KDF) (*memguard.LockedBuffer, error) {
+	return stretchPassword(masterPassword, salt, rootSecretContext, kdf)
+}
+
+// DeriveDecoyKey stretches the master password alone into the key that marks the decoys
+// it owns in constant-size vaults. It is as expensive as DeriveRootSecret.
+func DeriveDecoyKey(masterPassword *memguard.LockedBuffer, salt []byte, kdf KDF) (*memguard.LockedBuffer, error) {
+	return stretchPassword(masterPassword, salt, decoyKeyContext, kdf)
+}
+
+// stretchPassword derives a 32 byte secret from the master password alone, keeping
+// secrets for different purposes apart with context.
+func stretchPassword(masterPassword *memguard.LockedBuffer, salt []byte, context string, kdf KDF) (*memguard.LockedBuffer, error) {
+	// Bind the context to the salt, so that the password stays in locked memory.
+	keySlice, err := kdf.Key(masterPassword.Buffer, append(append([]byte{}, salt...), context...), 32)
+	if err != nil {
+		return nil, err
+	}
+	key, err := memguard.NewFromBytes(keySlice, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// Force the Go GC to do its job.
+	debug.FreeOSMemory()
+
+	return key, nil
+}
+
+// DeriveEntryValues derives a masterKey and rootIdentifier from a root secret and an
+// identifier. Nothing slows down guessing the identifier here, so it must be secret.
+func DeriveEntryValues(rootSecret, identifier *memguard.LockedBuffer) (*memguard.LockedBuffer, *memguard.LockedBuffer, error) {
+	h, err := blake2b.New512(rootSecret.Buffer)
+	if err != nil {
+		return nil, nil, err
+	}
+	h.Write([]byte(entryKeyContext))
+	h.Write(identifier.Buffer)
+
+	rootKey, err := memguard.NewFromBytes(h.Sum(nil), false)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rootKey.Destroy()
+
+	return memguard.Split(rootKey, 32)
 }
 
 // DeriveIdentifierN derives a value for derivedIdentifier for a value of `n`.
@@ -82,3 +138,43 @@ func DeriveMetaIdentifierN(rootIdentifier *memguard.LockedBuffer, n int) []byte
 	// Return as slice instead of array.
 	return derivedIdentifier[:]
 }
+
+// Domains keep the chunk keys for an entry's data apart from those for its metadata.
+const (
+	DomainData byte = 0
+	DomainMeta byte = 1
+)
+
+// chunkKeyContext ties chunk keys to this use of the master key.
+const chunkKeyContext = "dissident-chunk-v2"
+
+// DeriveChunkKey derives the key that chunk n of an entry is encrypted with, from the
+// master key, the domain, the hash of the root identifier, n, and whether it is the
+// final chunk in its domain. A chunk moved to any other index, domain or entry therefore
+// fails to decrypt, and so does one that is made to look like the end of an entry.
+func DeriveChunkKey(masterKey, rootIdentifier *memguard.LockedBuffer, domain byte, n uint64, final bool) (*memguard.LockedBuffer, error) {
+	h, err := blake2b.New256(masterKey.Buffer)
+	if err != nil {
+		return nil, err
+	}
+
+	// Hash the root identifier so that it is bound without being mixed in directly.
+	hashedRoot := blake2b.Sum256(rootIdentifier.Buffer)
+
+	// Convert n to a byte slice.
+	byteN := make([]byte, 8)
+	binary.LittleEndian.PutUint64(byteN, n)
+
+	// Mark the last chunk.
+	var flag byte
+	if final {
+		flag = 1
+	}
+
+	h.Write([]byte(chunkKeyContext))
+	h.Write([]byte{domain, flag})
+	h.Write(hashedRoot[:])
+	h.Write(byteN)
+
+	return memguard.NewFromBytes(h.Sum(nil), false)
+}
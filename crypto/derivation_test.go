@@ -12,7 +12,10 @@ func TestDeriveSecureValues(t *testing.T) {
 	masterPassword, _ := memguard.NewFromBytes([]byte("yellow submarine"), false)
 	identifier, _ := memguard.NewFromBytes([]byte("yellow submarine"), false)
 
-	masterKey, rootIdentifier := DeriveSecureValues(masterPassword, identifier, map[string]int{"N": 18, "r": 16, "p": 1})
+	masterKey, rootIdentifier, err := DeriveSecureValues(masterPassword, identifier, nil, Scrypt{LogN: 18, R: 16, P: 1})
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
 
 	actualMasterKey, _ := base64.StdEncoding.DecodeString("IQ0m0/Z7Oy/rvm67Pi0nj2Zk8N0u0Ba+t/uyhPVxTF8=")
 	actualRootIdentifier, _ := base64.StdEncoding.DecodeString("FIRp7dJQ2RvA7jsQX1DFWxxit6t9ERMyCSloA8iRmU4=")
@@ -26,6 +29,55 @@ func TestDeriveSecureValues(t *testing.T) {
 	}
 }
 
+func TestDeriveSecureValuesSalt(t *testing.T) {
+	masterPassword, _ := memguard.NewFromBytes([]byte("yellow submarine"), false)
+	identifier, _ := memguard.NewFromBytes([]byte("yellow submarine"), false)
+	cost := Scrypt{LogN: 10, R: 8, P: 1}
+
+	unsalted, _, _ := DeriveSecureValues(masterPassword, identifier, nil, cost)
+	salted, _, _ := DeriveSecureValues(masterPassword, identifier, []byte("salt"), cost)
+	otherSalt, _, _ := DeriveSecureValues(masterPassword, identifier, []byte("pepper"), cost)
+
+	if bytes.Equal(unsalted.Buffer, salted.Buffer) || bytes.Equal(salted.Buffer, otherSalt.Buffer) {
+		t.Error("Salt does not change the derived keys")
+	}
+}
+
+func TestDeriveEntryValues(t *testing.T) {
+	masterPassword, _ := memguard.NewFromBytes([]byte("yellow submarine"), false)
+	cost := Scrypt{LogN: 10, R: 8, P: 1}
+
+	rootSecret, err := DeriveRootSecret(masterPassword, []byte("salt"), cost)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if len(rootSecret.Buffer) != 32 {
+		t.Error("Expected 32 byte root secret; got", len(rootSecret.Buffer))
+	}
+
+	// The same identifier always gives the same values, and different ones don't.
+	identifier, _ := memguard.NewFromBytes([]byte("identifier"), false)
+	other, _ := memguard.NewFromBytes([]byte("identifiers"), false)
+	masterKey, rootIdentifier, err := DeriveEntryValues(rootSecret, identifier)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	again, _, _ := DeriveEntryValues(rootSecret, identifier)
+	otherKey, _, _ := DeriveEntryValues(rootSecret, other)
+	if !bytes.Equal(masterKey.Buffer, again.Buffer) || bytes.Equal(masterKey.Buffer, otherKey.Buffer) {
+		t.Error("Entry values don't depend on the identifier alone")
+	}
+	if len(masterKey.Buffer) != 32 || len(rootIdentifier.Buffer) != 32 || bytes.Equal(masterKey.Buffer, rootIdentifier.Buffer) {
+		t.Error("Unexpected entry values")
+	}
+
+	// The root secret is bound to its context, not just the password and salt.
+	direct, _ := cost.Key([]byte("yellow submarine"), []byte("salt"), 32)
+	if bytes.Equal(direct, rootSecret.Buffer) {
+		t.Error("Root secret is not separated from other uses of the KDF")
+	}
+}
+
 func TestDeriveIdentifierN(t *testing.T) {
 	rootIdentifierBytes, _ := base64.StdEncoding.DecodeString("FIRp7dJQ2RvA7jsQX1DFWxxit6t9ERMyCSloA8iRmU4=")
 	rootIdentifier, _ := memguard.NewFromBytes(rootIdentifierBytes, false)
@@ -59,3 +111,40 @@ func TestDeriveMetaIdentifierN(t *testing.T) {
 		}
 	}
 }
+
+func TestDeriveChunkKey(t *testing.T) {
+	masterKey, _ := memguard.NewFromBytes(bytes.Repeat([]byte{1}, 32), false)
+	rootIdentifier, _ := memguard.NewFromBytes(bytes.Repeat([]byte{2}, 32), false)
+	otherRoot, _ := memguard.NewFromBytes(bytes.Repeat([]byte{3}, 32), false)
+
+	key := func(root *memguard.LockedBuffer, domain byte, n uint64, final bool) string {
+		k, err := DeriveChunkKey(masterKey, root, domain, n, final)
+		if err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		if len(k.Buffer) != 32 {
+			t.Error("Expected 32 byte key; got", len(k.Buffer))
+		}
+		return string(k.Buffer)
+	}
+
+	// Every input must change the key.
+	seen := make(map[string]bool)
+	for _, k := range []string{
+		key(rootIdentifier, DomainData, 0, false),
+		key(rootIdentifier, DomainData, 1, false),
+		key(rootIdentifier, DomainData, 0, true),
+		key(rootIdentifier, DomainMeta, 0, false),
+		key(otherRoot, DomainData, 0, false),
+	} {
+		if seen[k] {
+			t.Error("Chunk keys collide")
+		}
+		seen[k] = true
+	}
+
+	// And be deterministic.
+	if key(rootIdentifier, DomainData, 5, true) != key(rootIdentifier, DomainData, 5, true) {
+		t.Error("Chunk key is not deterministic")
+	}
+}
@@ -8,11 +8,17 @@ import (
 	"golang.org/x/crypto/nacl/secretbox"
 )
 
+// ErrDecryptionFailed is returned when a ciphertext cannot be authenticated.
+var ErrDecryptionFailed = errors.New("! Decryption failed; data is likely corrupted")
+
 // Encrypt takes a plaintext and a 32 byte key, encrypts the plaintext with
 // said key using xSalsa20 with a Poly1305 MAC, and returns the ciphertext.
-func Encrypt(plaintext []byte, key *memguard.LockedBuffer) []byte {
+func Encrypt(plaintext []byte, key *memguard.LockedBuffer) ([]byte, error) {
 	// Generate a random nonce.
-	nonceSlice := GenerateRandomBytes(24)
+	nonceSlice, err := GenerateRandomBytes(24)
+	if err != nil {
+		return nil, err
+	}
 
 	// Store it in an array.
 	var nonce [24]byte
@@ -22,12 +28,17 @@ func Encrypt(plaintext []byte, key *memguard.LockedBuffer) []byte {
 	keyArrayPtr := (*[32]byte)(unsafe.Pointer(&key.Buffer[0]))
 
 	// Encrypt and return the plaintext.
-	return secretbox.Seal(nonce[:], plaintext, &nonce, keyArrayPtr)
+	return secretbox.Seal(nonce[:], plaintext, &nonce, keyArrayPtr), nil
 }
 
 // Decrypt takes a ciphertext and a 32 byte key, decrypts the ciphertext with
 // said key, and then returns the plaintext.
 func Decrypt(ciphertext []byte, key *memguard.LockedBuffer) ([]byte, error) {
+	// Make sure there is room for the nonce and MAC.
+	if len(ciphertext) < 24+secretbox.Overhead {
+		return nil, ErrDecryptionFailed
+	}
+
 	// Grab the nonce from the ciphertext and store it in an array.
 	var nonce [24]byte
 	copy(nonce[:], ciphertext[:24])
@@ -38,7 +49,7 @@ func Decrypt(ciphertext []byte, key *memguard.LockedBuffer) ([]byte, error) {
 	// Decrypt the ciphertext and store the result.
 	plaintext, okay := secretbox.Open([]byte{}, ciphertext[24:], &nonce, keyArrayPtr)
 	if !okay {
-		return nil, errors.New("! Decryption failed; data is likely corrupted")
+		return nil, ErrDecryptionFailed
 	}
 
 	// Return the resulting plaintext.
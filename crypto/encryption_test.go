@@ -26,8 +26,8 @@ func TestDecrypt(t *testing.T) {
 	// Incorrect key
 	key.Copy([]byte("lel"))
 	plaintext, err = Decrypt(ciphertext, key)
-	if err == nil {
-		t.Error("Expected error; got nil")
+	if err != ErrDecryptionFailed {
+		t.Error("Expected ErrDecryptionFailed; got", err)
 	}
 	if plaintext != nil {
 		t.Error("Expected plaintext to be nil; got", plaintext)
@@ -39,7 +39,10 @@ func TestEncryptionCycle(t *testing.T) {
 
 	key, _ := memguard.New(32, false)
 
-	ciphertext := Encrypt(plaintext, key)
+	ciphertext, err := Encrypt(plaintext, key)
+	if err != nil {
+		t.Error("Unexpected err:", err)
+	}
 	decrypted, err := Decrypt(ciphertext, key)
 	if err != nil {
 		t.Error("Unexpected err:", err)
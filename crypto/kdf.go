@@ -0,0 +1,125 @@
+package crypto
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// ErrInvalidKDF is returned when a KDF specification can't be parsed or its parameters
+// are out of range.
+var ErrInvalidKDF = errors.New("! Invalid KDF; use scrypt:N=<log2>,r=<r>,p=<p> or argon2id:t=<passes>,m=<KiB>,p=<threads>")
+
+// KDF stretches a password into key material. Implementations must be deterministic.
+type KDF interface {
+	// Key derives keyLen bytes from password and salt.
+	Key(password, salt []byte, keyLen int) ([]byte, error)
+
+	// String returns a specification of the KDF and its parameters that ParseKDF
+	// accepts.
+	String() string
+}
+
+// DefaultKDF is used for vaults that don't say otherwise.
+var DefaultKDF KDF = Scrypt{LogN: 18, R: 16, P: 1}
+
+// maxScryptLogN keeps scrypt's N within an int on 32-bit platforms.
+const maxScryptLogN = 30
+
+// Scrypt is the scrypt KDF with a cost of N = 2^LogN, where LogN is at most 30.
+type Scrypt struct {
+	LogN, R, P int
+}
+
+// Key implements KDF.
+func (s Scrypt) Key(password, salt []byte, keyLen int) ([]byte, error) {
+	if s.LogN < 1 || s.LogN > maxScryptLogN {
+		return nil, ErrInvalidKDF
+	}
+	return scrypt.Key(password, salt, 1<<uint(s.LogN), s.R, s.P, keyLen)
+}
+
+func (s Scrypt) String() string {
+	return fmt.Sprintf("scrypt:N=%d,r=%d,p=%d", s.LogN, s.R, s.P)
+}
+
+// Argon2id is the Argon2id KDF, making Time passes over Memory KiB with Threads lanes.
+type Argon2id struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+}
+
+// Key implements KDF.
+func (a Argon2id) Key(password, salt []byte, keyLen int) ([]byte, error) {
+	if a.Time < 1 || a.Threads < 1 {
+		return nil, ErrInvalidKDF
+	}
+	return argon2.IDKey(password, salt, a.Time, a.Memory, a.Threads, uint32(keyLen)), nil
+}
+
+func (a Argon2id) String() string {
+	return fmt.Sprintf("argon2id:t=%d,m=%d,p=%d", a.Time, a.Memory, a.Threads)
+}
+
+// ParseKDF parses a specification such as "scrypt:N=18,r=16,p=1" or
+// "argon2id:t=3,m=65536,p=4". Parameters that are left out take their default values.
+func ParseKDF(spec string) (KDF, error) {
+	name, args := spec, ""
+	if i := strings.IndexByte(spec, ':'); i >= 0 {
+		name, args = spec[:i], spec[i+1:]
+	}
+
+	// Collect the parameters.
+	values := make(map[string]uint64)
+	if args != "" {
+		for _, arg := range strings.Split(args, ",") {
+			kv := strings.SplitN(arg, "=", 2)
+			if len(kv) != 2 {
+				return nil, ErrInvalidKDF
+			}
+			v, err := strconv.ParseUint(kv[1], 10, 64)
+			if err != nil {
+				return nil, ErrInvalidKDF
+			}
+			values[kv[0]] = v
+		}
+	}
+	get := func(key string, def uint64) uint64 {
+		v, ok := values[key]
+		if !ok {
+			return def
+		}
+		delete(values, key)
+		return v
+	}
+
+	var kdf KDF
+	switch name {
+	case "scrypt":
+		n, r, p := get("N", 18), get("r", 16), get("p", 1)
+		if n < 1 || n > maxScryptLogN || r < 1 || r >= 1<<30 || p < 1 || p >= 1<<30 || r*p >= 1<<30 {
+			return nil, ErrInvalidKDF
+		}
+		kdf = Scrypt{LogN: int(n), R: int(r), P: int(p)}
+	case "argon2id":
+		t, m, p := get("t", 3), get("m", 64*1024), get("p", 4)
+		if t < 1 || t > math.MaxUint32 || p < 1 || p > math.MaxUint8 || m < 8*p || m > math.MaxUint32 {
+			return nil, ErrInvalidKDF
+		}
+		kdf = Argon2id{Time: uint32(t), Memory: uint32(m), Threads: uint8(p)}
+	default:
+		return nil, ErrInvalidKDF
+	}
+
+	// Anything left over wasn't recognised.
+	if len(values) != 0 {
+		return nil, ErrInvalidKDF
+	}
+	return kdf, nil
+}
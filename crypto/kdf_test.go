@@ -0,0 +1,53 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestParseKDF(t *testing.T) {
+	for spec, expected := range map[string]KDF{
+		"scrypt":                     Scrypt{LogN: 18, R: 16, P: 1},
+		"scrypt:N=20":                Scrypt{LogN: 20, R: 16, P: 1},
+		"scrypt:N=10,r=8,p=2":        Scrypt{LogN: 10, R: 8, P: 2},
+		"argon2id":                   Argon2id{Time: 3, Memory: 64 * 1024, Threads: 4},
+		"argon2id:t=1,m=1048576,p=8": Argon2id{Time: 1, Memory: 1 << 20, Threads: 8},
+	} {
+		kdf, err := ParseKDF(spec)
+		if err != nil || kdf != expected {
+			t.Error("Unexpected result for", spec, kdf, err)
+		}
+
+		// The string form parses back to the same thing.
+		if again, err := ParseKDF(kdf.String()); err != nil || again != kdf {
+			t.Error("Failed to round trip", kdf)
+		}
+	}
+
+	for _, spec := range []string{"", "bcrypt", "scrypt:N", "scrypt:N=x", "scrypt:N=0", "scrypt:N=31", "scrypt:N=-1", "scrypt:q=1", "argon2id:p=0", "argon2id:m=8,p=4", "argon2id:t=4294967296", "argon2id:p=256"} {
+		if _, err := ParseKDF(spec); err != ErrInvalidKDF {
+			t.Error("Expected ErrInvalidKDF for", spec, "; got", err)
+		}
+	}
+}
+
+func TestKDFs(t *testing.T) {
+	for _, kdf := range []KDF{Scrypt{LogN: 10, R: 8, P: 1}, Argon2id{Time: 1, Memory: 64, Threads: 2}} {
+		a, err := kdf.Key([]byte("password"), []byte("salt"), 64)
+		if err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		b, _ := kdf.Key([]byte("password"), []byte("pepper"), 64)
+		if len(a) != 64 || bytes.Equal(a, b) {
+			t.Error("Unexpected output from", kdf)
+		}
+	}
+
+	// Keys must never change, or vaults become unreadable.
+	key, err := Argon2id{Time: 2, Memory: 100, Threads: 3}.Key([]byte("password"), []byte("somesalt"), 64)
+	expected := "731448a0404a1c7f8a3ad1e2fbea88615dd27af1bdbfe0c6741fe3938e80d147bdf1203c3622fdbb092b66d45704ca939b8d5470cfb7d023ce6d0394927bb3fe"
+	if err != nil || hex.EncodeToString(key) != expected {
+		t.Errorf("Key != expected; got %x", key)
+	}
+}
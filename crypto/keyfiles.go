@@ -0,0 +1,56 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sort"
+
+	"github.com/awnumar/memguard"
+	"golang.org/x/crypto/blake2b"
+)
+
+// ErrEmptyKeyfile is returned for keyfiles with nothing in them, which would add
+// nothing secret.
+var ErrEmptyKeyfile = errors.New("! Keyfile is empty")
+
+// keyfileContext ties the combined digest of the keyfiles to this use.
+const keyfileContext = "dissident-keyfiles-v1"
+
+// HashKeyfiles reads each keyfile to the end and combines their BLAKE2b digests into a
+// single secret. The order in which they are given makes no difference.
+func HashKeyfiles(keyfiles ...io.Reader) (*memguard.LockedBuffer, error) {
+	digests := make([][]byte, len(keyfiles))
+	for i, r := range keyfiles {
+		h, _ := blake2b.New256(nil)
+		n, err := io.Copy(h, r)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return nil, ErrEmptyKeyfile
+		}
+		digests[i] = h.Sum(nil)
+	}
+
+	// Sort the digests so that the order doesn't matter.
+	sort.Slice(digests, func(i, j int) bool {
+		return bytes.Compare(digests[i], digests[j]) < 0
+	})
+
+	h, _ := blake2b.New256(nil)
+	h.Write([]byte(keyfileContext))
+	for _, digest := range digests {
+		h.Write(digest)
+		memguard.WipeBytes(digest)
+	}
+
+	return memguard.NewFromBytes(h.Sum(nil), false)
+}
+
+// AddKeyfiles mixes a secret from HashKeyfiles into a master password, returning what
+// is used as the master password from then on. Without the keyfiles, the same keys
+// can't be derived.
+func AddKeyfiles(masterPassword, keyfiles *memguard.LockedBuffer) (*memguard.LockedBuffer, error) {
+	return memguard.Concatenate(masterPassword, keyfiles)
+}
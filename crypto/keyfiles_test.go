@@ -0,0 +1,59 @@
+package crypto
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/awnumar/memguard"
+)
+
+func TestHashKeyfiles(t *testing.T) {
+	a, err := HashKeyfiles(strings.NewReader("usb stick"), strings.NewReader("photo"))
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	b, _ := HashKeyfiles(strings.NewReader("photo"), strings.NewReader("usb stick"))
+	c, _ := HashKeyfiles(strings.NewReader("photo"))
+
+	if len(a.Buffer) != 32 || !bytes.Equal(a.Buffer, b.Buffer) {
+		t.Error("Digest depends on the order of the keyfiles")
+	}
+	if bytes.Equal(a.Buffer, c.Buffer) {
+		t.Error("Digest doesn't depend on every keyfile")
+	}
+
+	if _, err := HashKeyfiles(strings.NewReader("photo"), strings.NewReader("")); err != ErrEmptyKeyfile {
+		t.Error("Expected ErrEmptyKeyfile; got", err)
+	}
+}
+
+func TestAddKeyfiles(t *testing.T) {
+	keyfiles, _ := HashKeyfiles(strings.NewReader("usb stick"))
+	other, _ := HashKeyfiles(strings.NewReader("another stick"))
+	identifier, _ := memguard.NewFromBytes([]byte("identifier"), false)
+	cost := Scrypt{LogN: 10, R: 8, P: 1}
+
+	derive := func(keyfiles *memguard.LockedBuffer) []byte {
+		password, _ := memguard.NewFromBytes([]byte("yellow submarine"), false)
+		if keyfiles != nil {
+			var err error
+			if password, err = AddKeyfiles(password, keyfiles); err != nil {
+				t.Fatal("Unexpected error:", err)
+			}
+		}
+		masterKey, _, err := DeriveSecureValues(password, identifier, nil, cost)
+		if err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		return masterKey.Buffer
+	}
+
+	with, without, wrong := derive(keyfiles), derive(nil), derive(other)
+	if bytes.Equal(with, without) || bytes.Equal(with, wrong) {
+		t.Error("Keyfiles don't change the derived keys")
+	}
+	if !bytes.Equal(with, derive(keyfiles)) {
+		t.Error("Keyfiles don't give the same keys every time")
+	}
+}
@@ -5,6 +5,9 @@ import (
 	"fmt"
 )
 
+// ErrInvalidPadding is returned when unpadding data that was not correctly padded.
+var ErrInvalidPadding = errors.New("! Invalid padding")
+
 // Pad implements byte padding.
 func Pad(text []byte, padTo int) ([]byte, error) {
 	// Check if input is even valid.
@@ -36,7 +39,7 @@ func Unpad(text []byte) ([]byte, error) {
 			text = text[:len(text)-1]
 			break
 		} else {
-			return nil, errors.New("! Invalid padding")
+			return nil, ErrInvalidPadding
 		}
 	}
 
@@ -89,8 +89,8 @@ func TestUnpad(t *testing.T) {
 
 	// Test invalid padding.
 	unpadded, err = Unpad(text)
-	if err == nil {
-		t.Error("Expected an error since inputs are invalid; unpadded:", unpadded)
+	if err != ErrInvalidPadding {
+		t.Error("Expected ErrInvalidPadding since inputs are invalid; unpadded:", unpadded)
 	}
 	if unpadded != nil {
 		t.Error("Expected unpadded to be nil; unpadded =", unpadded)
@@ -0,0 +1,129 @@
+package crypto
+
+import (
+	"errors"
+
+	"github.com/awnumar/memguard"
+	gcmsiv "github.com/google/tink/go/aead/subtle"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// ErrInvalidSuite is returned for cipher suites that aren't known.
+var ErrInvalidSuite = errors.New("! Unknown cipher suite; use xsalsa20poly1305, xchacha20poly1305 or aes256gcmsiv")
+
+// Suite is an authenticated cipher with a 32 byte key and a random nonce, which is
+// stored at the start of each ciphertext. Every ciphertext is Overhead bytes longer
+// than its plaintext, so as long as a vault sticks to one suite all of its chunks are
+// the same size.
+type Suite interface {
+	// Encrypt encrypts and authenticates plaintext with key.
+	Encrypt(plaintext []byte, key *memguard.LockedBuffer) ([]byte, error)
+
+	// Decrypt authenticates and decrypts ciphertext with key, returning
+	// ErrDecryptionFailed if it has been tampered with.
+	Decrypt(ciphertext []byte, key *memguard.LockedBuffer) ([]byte, error)
+
+	// Overhead is the number of bytes that encryption adds.
+	Overhead() int
+
+	// String returns the name that ParseSuite accepts.
+	String() string
+}
+
+var (
+	// XSalsa20Poly1305 is NaCl's secretbox, which vaults have always used.
+	XSalsa20Poly1305 Suite = xsalsa20Poly1305{}
+
+	// XChaCha20Poly1305 is ChaCha20-Poly1305 with 24 byte nonces. It is faster than
+	// XSalsa20Poly1305 where the vendored ChaCha20-Poly1305 has assembly.
+	XChaCha20Poly1305 Suite = xchacha20Poly1305{}
+
+	// AES256GCMSIV is AES-256-GCM-SIV, as implemented by Tink. It stays secure if the
+	// random number generator ever repeats a nonce, and uses AES instructions where
+	// there are some.
+	AES256GCMSIV Suite = aes256GCMSIV{}
+)
+
+// DefaultSuite is used for vaults that don't say otherwise.
+var DefaultSuite = XSalsa20Poly1305
+
+// ParseSuite returns the suite with the given name.
+func ParseSuite(name string) (Suite, error) {
+	for _, suite := range []Suite{XSalsa20Poly1305, XChaCha20Poly1305, AES256GCMSIV} {
+		if suite.String() == name {
+			return suite, nil
+		}
+	}
+	return nil, ErrInvalidSuite
+}
+
+type xsalsa20Poly1305 struct{}
+
+func (xsalsa20Poly1305) Encrypt(plaintext []byte, key *memguard.LockedBuffer) ([]byte, error) {
+	return Encrypt(plaintext, key)
+}
+
+func (xsalsa20Poly1305) Decrypt(ciphertext []byte, key *memguard.LockedBuffer) ([]byte, error) {
+	return Decrypt(ciphertext, key)
+}
+
+func (xsalsa20Poly1305) Overhead() int  { return 24 + 16 }
+func (xsalsa20Poly1305) String() string { return "xsalsa20poly1305" }
+
+type xchacha20Poly1305 struct{}
+
+func (xchacha20Poly1305) Encrypt(plaintext []byte, key *memguard.LockedBuffer) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key.Buffer)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := GenerateRandomBytes(chacha20poly1305.NonceSizeX)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func (xchacha20Poly1305) Decrypt(ciphertext []byte, key *memguard.LockedBuffer) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key.Buffer)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize()+aead.Overhead() {
+		return nil, ErrDecryptionFailed
+	}
+	plaintext, err := aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+	return plaintext, nil
+}
+
+func (xchacha20Poly1305) Overhead() int  { return chacha20poly1305.NonceSizeX + 16 }
+func (xchacha20Poly1305) String() string { return "xchacha20poly1305" }
+
+type aes256GCMSIV struct{}
+
+func (aes256GCMSIV) Encrypt(plaintext []byte, key *memguard.LockedBuffer) ([]byte, error) {
+	aead, err := gcmsiv.NewAESGCMSIV(key.Buffer)
+	if err != nil {
+		return nil, err
+	}
+	// The nonce comes first, then the ciphertext and the tag.
+	return aead.Encrypt(plaintext, nil)
+}
+
+func (aes256GCMSIV) Decrypt(ciphertext []byte, key *memguard.LockedBuffer) ([]byte, error) {
+	aead, err := gcmsiv.NewAESGCMSIV(key.Buffer)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Decrypt(ciphertext, nil)
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+	return plaintext, nil
+}
+
+func (aes256GCMSIV) Overhead() int  { return gcmsiv.AESGCMSIVNonceSize + 16 }
+func (aes256GCMSIV) String() string { return "aes256gcmsiv" }
@@ -0,0 +1,88 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/awnumar/memguard"
+)
+
+func TestSuites(t *testing.T) {
+	plaintext := []byte("this is a test plaintext")
+
+	for _, suite := range []Suite{XSalsa20Poly1305, XChaCha20Poly1305, AES256GCMSIV} {
+		if parsed, err := ParseSuite(suite.String()); err != nil || parsed != suite {
+			t.Error("Failed to parse", suite, err)
+		}
+
+		key, _ := memguard.NewRandom(32, false)
+		ciphertext, err := suite.Encrypt(plaintext, key)
+		if err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		if len(ciphertext) != len(plaintext)+suite.Overhead() {
+			t.Error(suite, "ciphertext has length", len(ciphertext))
+		}
+		decrypted, err := suite.Decrypt(ciphertext, key)
+		if err != nil || !bytes.Equal(decrypted, plaintext) {
+			t.Error(suite, "failed to decrypt:", err)
+		}
+
+		// Tampering anywhere is noticed.
+		for _, i := range []int{0, suite.Overhead() - 1, len(ciphertext) - 1} {
+			ciphertext[i] ^= 1
+			if _, err := suite.Decrypt(ciphertext, key); err != ErrDecryptionFailed {
+				t.Error(suite, "expected ErrDecryptionFailed; got", err)
+			}
+			ciphertext[i] ^= 1
+		}
+		if _, err := suite.Decrypt(ciphertext[:suite.Overhead()-1], key); err != ErrDecryptionFailed {
+			t.Error(suite, "expected ErrDecryptionFailed; got", err)
+		}
+	}
+
+	if _, err := ParseSuite("rot13"); err != ErrInvalidSuite {
+		t.Error("Expected ErrInvalidSuite; got", err)
+	}
+}
+
+func TestXChaCha20Poly1305(t *testing.T) {
+	key, _ := memguard.New(32, false)
+	for i := range key.Buffer {
+		key.Buffer[i] = byte(i)
+	}
+
+	// The nonce comes first, then the ciphertext as golang.org/x/crypto/chacha20poly1305.NewX
+	// produces it.
+	ciphertext := unhex("404142434445464748494a4b4c4d4e4f5051525354555657" +
+		"ad5c691cbf975965fa96eadfddf50bf7be9accaa777927f20f5fdd36666946b07b96700b48c1674ba79d35acc020de035ba9a916")
+	plaintext, err := XChaCha20Poly1305.Decrypt(ciphertext, key)
+	if err != nil || string(plaintext) != "yellow submarine, and then some more" {
+		t.Errorf("Failed to decrypt: %q %v", plaintext, err)
+	}
+}
+
+func TestAES256GCMSIV(t *testing.T) {
+	key, _ := memguard.New(32, false)
+	key.Buffer[0] = 1
+
+	// From RFC 8452, appendix C.2, with the nonce in front.
+	for _, v := range []struct{ plaintext, ciphertext string }{
+		{"", "030000000000000000000000" + "07f5f4169bbf55a8400cd47ea6fd400f"},
+		{"0100000000000000", "030000000000000000000000" + "c2ef328e5c71c83b843122130f7364b761e0b97427e3df28"},
+	} {
+		plaintext, err := AES256GCMSIV.Decrypt(unhex(v.ciphertext), key)
+		if err != nil || !bytes.Equal(plaintext, unhex(v.plaintext)) {
+			t.Errorf("Failed to decrypt %s: %x %v", v.ciphertext, plaintext, err)
+		}
+	}
+}
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
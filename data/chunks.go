@@ -0,0 +1,105 @@
+package data
+
+import (
+	"github.com/awnumar/dissident/coffer"
+	"github.com/awnumar/dissident/crypto"
+	"github.com/awnumar/memguard"
+)
+
+// Protocol versions an entry can be stored under.
+const (
+	// Version1 entries have every chunk encrypted directly with the master key, so
+	// chunks can be swapped around or cut off without decryption failing.
+	Version1 = 1
+
+	// Version2 entries have every chunk encrypted with a key bound to the entry, the
+	// chunk's domain and index, and whether it is the last one. New entries are always
+	// stored this way.
+	Version2 = 2
+)
+
+// EntryVersion works out which protocol version an entry is stored under by trying to
+// decrypt its first metadata chunk.
+func EntryVersion(db coffer.Store, format *Format, rootIdentifier, masterKey *memguard.LockedBuffer) (int, error) {
+	ct, err := db.Retrieve(crypto.DeriveMetaIdentifierN(rootIdentifier, -1))
+	if err != nil {
+		return 0, err
+	}
+	if ct == nil {
+		return 0, ErrMetadataMissing
+	}
+
+	// Newer versions are tried first.
+	for _, version := range []int{Version2, Version1} {
+		pt, _, err := openChunk(format, ct, version, crypto.DomainMeta, 0, rootIdentifier, masterKey)
+		if err == nil {
+			memguard.WipeBytes(pt)
+			return version, nil
+		}
+		if err != crypto.ErrDecryptionFailed {
+			return 0, err
+		}
+	}
+
+	return 0, crypto.ErrDecryptionFailed
+}
+
+// sealChunk pads and encrypts at most a chunk's worth of data as chunk n of an entry in the given
+// domain, using the current protocol version. Exactly one chunk in each domain must be
+// marked as final.
+func sealChunk(format *Format, chunk []byte, domain byte, n uint64, final bool, rootIdentifier, masterKey *memguard.LockedBuffer) ([]byte, error) {
+	// Pad the chunk to standard size.
+	padded, err := crypto.Pad(chunk, format.chunkSize())
+	if err != nil {
+		return nil, err
+	}
+	defer memguard.WipeBytes(padded)
+
+	// Derive the key for this chunk.
+	key, err := crypto.DeriveChunkKey(masterKey, rootIdentifier, domain, n, final)
+	if err != nil {
+		return nil, err
+	}
+	defer key.Destroy()
+
+	return format.suite().Encrypt(padded, key)
+}
+
+// openChunk decrypts and unpads chunk n of an entry in the given domain, stored under
+// the given protocol version, and reports whether it is the final chunk. Version 1
+// chunks are never marked as final. The plaintext is never nil, even when empty.
+func openChunk(format *Format, ct []byte, version int, domain byte, n uint64, rootIdentifier, masterKey *memguard.LockedBuffer) ([]byte, bool, error) {
+	if version == Version1 {
+		pt, err := unsealChunk(format, ct, masterKey)
+		return pt, false, err
+	}
+
+	// Most chunks aren't final, so try that first.
+	for _, final := range []bool{false, true} {
+		key, err := crypto.DeriveChunkKey(masterKey, rootIdentifier, domain, n, final)
+		if err != nil {
+			return nil, false, err
+		}
+		pt, err := unsealChunk(format, ct, key)
+		key.Destroy()
+		if err != crypto.ErrDecryptionFailed {
+			return pt, final, err
+		}
+	}
+
+	return nil, false, crypto.ErrDecryptionFailed
+}
+
+// unsealChunk decrypts a chunk with the given key and unpads it.
+func unsealChunk(format *Format, ct []byte, key *memguard.LockedBuffer) ([]byte, error) {
+	// Decrypt this slice.
+	pt, err := format.suite().Decrypt(ct, key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Unpad this slice and wipe old one.
+	unpadded, err := crypto.Unpad(pt)
+	memguard.WipeBytes(pt)
+	return unpadded, err
+}
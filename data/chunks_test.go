@@ -0,0 +1,187 @@
+package data
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"github.com/awnumar/dissident/coffer"
+	"github.com/awnumar/dissident/crypto"
+	"github.com/awnumar/memguard"
+)
+
+// importV1 stores plaintext the way version 1 did, with every chunk encrypted directly
+// under the master key.
+func importV1(t *testing.T, db coffer.Store, plaintext []byte, rootIdentifier, masterKey *memguard.LockedBuffer) {
+	save := func(id, chunk []byte) {
+		padded, _ := crypto.Pad(chunk, 4096)
+		ciphertext, err := crypto.Encrypt(padded, masterKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.Save(id, ciphertext)
+	}
+
+	for n := 0; n*4095 < len(plaintext); n++ {
+		end := (n + 1) * 4095
+		if end > len(plaintext) {
+			end = len(plaintext)
+		}
+		save(crypto.DeriveIdentifierN(rootIdentifier, uint64(n)), plaintext[n*4095:end])
+	}
+	save(crypto.DeriveMetaIdentifierN(rootIdentifier, -1), []byte(fmt.Sprintf(`{"length":%d}`, len(plaintext))))
+}
+
+func TestChunkSwapping(t *testing.T) {
+	plaintext, _ := crypto.GenerateRandomBytes(10000)
+
+	db := coffer.NewMemory()
+	rootIdentifier, masterKey := testKeys(t)
+	if err := ImportData(db, nil, bytes.NewReader(plaintext), nil, rootIdentifier, masterKey); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if v, err := EntryVersion(db, nil, rootIdentifier, masterKey); err != nil || v != Version2 {
+		t.Error("Expected new entries to use version 2; got", v, err)
+	}
+
+	// Swap the first two chunks around.
+	first, second := crypto.DeriveIdentifierN(rootIdentifier, 0), crypto.DeriveIdentifierN(rootIdentifier, 1)
+	a, _ := db.Retrieve(first)
+	b, _ := db.Retrieve(second)
+	db.Save(first, b)
+	db.Save(second, a)
+
+	var out bytes.Buffer
+	if err := ExportData(db, nil, &out, rootIdentifier, masterKey); err != crypto.ErrDecryptionFailed {
+		t.Error("Expected ErrDecryptionFailed; got", err)
+	}
+
+	// Moving a data chunk into the metadata doesn't work either.
+	db.Save(crypto.DeriveMetaIdentifierN(rootIdentifier, -1), a)
+	if _, err := MetaGet(db, nil, rootIdentifier, masterKey); err != crypto.ErrDecryptionFailed {
+		t.Error("Expected ErrDecryptionFailed; got", err)
+	}
+}
+
+func TestMigrateData(t *testing.T) {
+	plaintext, _ := crypto.GenerateRandomBytes(10000)
+
+	db := coffer.NewMemory()
+	rootIdentifier, masterKey := testKeys(t)
+	importV1(t, db, plaintext, rootIdentifier, masterKey)
+
+	if v, err := EntryVersion(db, nil, rootIdentifier, masterKey); err != nil || v != Version1 {
+		t.Fatal("Expected version 1; got", v, err)
+	}
+
+	// Old entries can still be read.
+	var out bytes.Buffer
+	if err := ExportData(db, nil, &out, rootIdentifier, masterKey); err != nil || !bytes.Equal(out.Bytes(), plaintext) {
+		t.Error("Failed to export version 1 entry:", err)
+	}
+
+	if err := MigrateData(db, nil, rootIdentifier, masterKey); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if v, err := EntryVersion(db, nil, rootIdentifier, masterKey); err != nil || v != Version2 {
+		t.Error("Expected version 2 after migrating; got", v, err)
+	}
+	if db.Len() != 4 {
+		t.Error("Expected 3 data chunks and 1 metadata chunk; got", db.Len())
+	}
+
+	out.Reset()
+	if err := ExportData(db, nil, &out, rootIdentifier, masterKey); err != nil || !bytes.Equal(out.Bytes(), plaintext) {
+		t.Error("Failed to export migrated entry:", err)
+	}
+
+	// Migrating again does nothing.
+	if err := MigrateData(db, nil, rootIdentifier, masterKey); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+
+	// Old entries ending in a full chunk gain an empty final one.
+	db = coffer.NewMemory()
+	importV1(t, db, plaintext[:4095], rootIdentifier, masterKey)
+	if err := MigrateData(db, nil, rootIdentifier, masterKey); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	out.Reset()
+	if err := ExportData(db, nil, &out, rootIdentifier, masterKey); err != nil || !bytes.Equal(out.Bytes(), plaintext[:4095]) {
+		t.Error("Failed to export migrated entry:", err)
+	}
+	if db.Len() != 3 {
+		t.Error("Expected 2 data chunks and 1 metadata chunk; got", db.Len())
+	}
+}
+
+func TestTruncation(t *testing.T) {
+	for _, size := range []int{0, 4095, 10000} {
+		plaintext, _ := crypto.GenerateRandomBytes(size)
+
+		db := coffer.NewMemory()
+		rootIdentifier, masterKey := testKeys(t)
+		if err := ImportData(db, nil, bytes.NewReader(plaintext), nil, rootIdentifier, masterKey); err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+
+		// There is always a short final chunk, even if it is empty.
+		chunks := size/4095 + 1
+		if db.Len() != chunks+1 {
+			t.Errorf("Expected %d data chunks and 1 metadata chunk; got %d", chunks, db.Len())
+		}
+
+		var out bytes.Buffer
+		if err := ExportData(db, nil, &out, rootIdentifier, masterKey); err != nil || !bytes.Equal(out.Bytes(), plaintext) {
+			t.Error("Failed to export", size, "bytes:", err)
+		}
+
+		// Add a chunk past the end.
+		last := crypto.DeriveIdentifierN(rootIdentifier, uint64(chunks-1))
+		ct, _ := db.Retrieve(last)
+		db.Save(crypto.DeriveIdentifierN(rootIdentifier, uint64(chunks)), ct)
+		if err := ExportData(db, nil, ioutil.Discard, rootIdentifier, masterKey); err != ErrEntryTruncated {
+			t.Error("Expected ErrEntryTruncated for extended entry; got", err)
+		}
+		db.Delete(crypto.DeriveIdentifierN(rootIdentifier, uint64(chunks)))
+
+		// Cut off the final chunk. Without it, nothing else can be made to look final.
+		if chunks > 1 {
+			db.Delete(last)
+			if err := ExportData(db, nil, ioutil.Discard, rootIdentifier, masterKey); err != ErrEntryTruncated {
+				t.Error("Expected ErrEntryTruncated for truncated entry; got", err)
+			}
+		}
+	}
+}
+
+func TestRekeyData(t *testing.T) {
+	plaintext, _ := crypto.GenerateRandomBytes(10000)
+
+	db := coffer.NewMemory()
+	rootIdentifier, masterKey := testKeys(t)
+	newRootIdentifier, newMasterKey := testKeys(t)
+	importV1(t, db, plaintext, rootIdentifier, masterKey)
+
+	if err := RekeyData(db, nil, rootIdentifier, masterKey, newRootIdentifier, newMasterKey); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if exists, _ := Exists(db, rootIdentifier); exists {
+		t.Error("Old entry was left behind")
+	}
+	if db.Len() != 4 {
+		t.Error("Expected 3 data chunks and 1 metadata chunk; got", db.Len())
+	}
+
+	var out bytes.Buffer
+	if err := ExportData(db, nil, &out, newRootIdentifier, newMasterKey); err != nil || !bytes.Equal(out.Bytes(), plaintext) {
+		t.Error("Failed to export moved entry:", err)
+	}
+
+	// It can't be moved on top of another entry.
+	importV1(t, db, plaintext, rootIdentifier, masterKey)
+	if err := RekeyData(db, nil, rootIdentifier, masterKey, newRootIdentifier, newMasterKey); err != ErrEntryExists {
+		t.Error("Expected ErrEntryExists; got", err)
+	}
+}
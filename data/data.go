@@ -1,212 +1,397 @@
 package data
 
 import (
-	"fmt"
+	"bytes"
+	"errors"
 	"io"
-	"math"
-	"os"
+	"time"
 
 	"github.com/awnumar/dissident/coffer"
 	"github.com/awnumar/dissident/crypto"
 	"github.com/awnumar/memguard"
-	"github.com/cheggaaa/pb"
+	"golang.org/x/crypto/blake2b"
 )
 
-// ImportData reads a file from the disk and imports it.
-func ImportData(path string, fileSize int64, rootIdentifier, masterKey *memguard.LockedBuffer) {
-	// Open the file.
-	f, err := os.Open(path)
+var (
+	// ErrEntryNotFound is returned when there is no entry for a root identifier.
+	ErrEntryNotFound = errors.New("! This entry does not exist")
+
+	// ErrEntryExists is returned when importing over an existing entry.
+	ErrEntryExists = errors.New("! Cannot overwrite existing entry")
+
+	// ErrDataIncomplete is returned when the exported data does not match the length
+	// recorded in the metadata.
+	ErrDataIncomplete = errors.New("! Data incomplete; database may be corrupt")
+
+	// ErrHashMismatch is returned when the exported data does not match the hash
+	// recorded in the metadata.
+	ErrHashMismatch = errors.New("! Hash mismatch; data has been corrupted or tampered with")
+
+	// ErrEntryTruncated is returned when an entry does not end with its final chunk,
+	// meaning that chunks have been removed from or added to the end of it.
+	ErrEntryTruncated = errors.New("! Entry has been truncated or extended; data has been tampered with")
+)
+
+// Exists checks whether an entry is stored under rootIdentifier.
+func Exists(db coffer.Store, rootIdentifier *memguard.LockedBuffer) (bool, error) {
+	return db.Exists(crypto.DeriveIdentifierN(rootIdentifier, 0))
+}
+
+// ImportData reads everything from r and imports it, along with its metadata. The length,
+// hash and creation time are filled in once all of the data has been read, and the MIME
+// type is sniffed from the data if it isn't set; any other attributes are taken from
+// meta, which may be nil. Nothing is written to the coffer unless all of it is imported
+// successfully.
+func ImportData(db coffer.Backend, format *Format, r io.Reader, meta *Metadata, rootIdentifier, masterKey *memguard.LockedBuffer) error {
+	// Check if it exists already.
+	exists, err := Exists(db, rootIdentifier)
 	if err != nil {
-		if os.IsPermission(err) {
-			fmt.Printf("! Insufficient permissions to open %s\n", path)
-		} else {
-			fmt.Println(err)
-		}
-		return
-	}
-	defer f.Close()
-
-	// Start the progress bar.
-	bar := pb.New64(fileSize).Prefix("+ Importing ")
-	bar.ShowSpeed = true
-	bar.SetUnits(pb.U_BYTES)
-	bar.Start()
-
-	// Import the data.
-	var chunkIndex uint64
-	buffer := make([]byte, 4095)
-	for {
-		b, err := f.Read(buffer)
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			fmt.Println(err)
-			return
-		}
-		bar.Add(b) // Increment the progress bar.
+		return err
+	}
+	if exists {
+		return ErrEntryExists
+	}
 
-		data := make([]byte, b)
-		copy(data, buffer[:b])
+	// Group every write into a single transaction.
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Discard()
 
-		// Pad data and wipe the buffer.
-		data, err = crypto.Pad(data, 4096)
-		if err != nil {
-			fmt.Println(err)
-			return
+	if meta == nil {
+		meta = new(Metadata)
+	}
+
+	// Read the data in order, and encrypt several chunks of it at once.
+	var length int64
+	hash, _ := blake2b.New256(nil)
+	var read bool
+	produce := func(n uint64) (*chunk, error) {
+		if read {
+			return nil, nil
+		}
+		buffer := make([]byte, format.dataSize())
+		b, err := io.ReadFull(r, buffer)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			memguard.WipeBytes(buffer)
+			return nil, err
 		}
-		memguard.WipeBytes(buffer)
+		length += int64(b)
+		hash.Write(buffer[:b])
 
-		// Save it and wipe plaintext.
-		coffer.Save(crypto.DeriveIdentifierN(rootIdentifier, chunkIndex), crypto.Encrypt(data, masterKey))
-		memguard.WipeBytes(data)
+		// Guess the type from the start of the data.
+		if n == 0 && meta.MIME == "" {
+			meta.MIME = sniffMIME(buffer[:b])
+		}
+
+		// The last chunk is always short, even if that means it is empty.
+		read = b < len(buffer)
+		return &chunk{data: buffer[:b], final: read}, nil
+	}
+	process := func(c *chunk) {
+		// Encrypt it and wipe the buffer.
+		ciphertext, err := sealChunk(format, c.data, crypto.DomainData, c.n, c.final, rootIdentifier, masterKey)
+		memguard.WipeBytes(c.data)
+		c.data, c.err = ciphertext, err
+	}
+	consume := func(c *chunk) error {
+		if c.err != nil {
+			return c.err
+		}
+		return tx.Save(crypto.DeriveIdentifierN(rootIdentifier, c.n), c.data)
+	}
+	if err := runPipeline(format.buffers(), produce, process, consume, nil); err != nil {
+		return err
+	}
 
-		// Increment counter.
-		chunkIndex++
+	// Add the metadata.
+	meta.Length = length
+	meta.Hash = hash.Sum(nil)
+	if meta.Created.IsZero() {
+		meta.Created = time.Now().UTC()
 	}
-	// We're done. End the progress bar.
-	bar.Finish()
+	if err := MetaSet(tx, format, meta, rootIdentifier, masterKey); err != nil {
+		return err
+	}
+
+	// Apply everything at once.
+	return tx.Commit()
 }
 
-// ExportData exports data from coffer to the disk.
-func ExportData(path string, rootIdentifier, masterKey *memguard.LockedBuffer) {
-	// Atempt to open the file now.
-	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0666)
+// ExportData decrypts an entry and writes it to w. The data is checked against the hash
+// in its metadata, if there is one, but only once all of it has been written.
+func ExportData(db coffer.Store, format *Format, w io.Writer, rootIdentifier, masterKey *memguard.LockedBuffer) error {
+	// Check if this entry exists.
+	exists, err := Exists(db, rootIdentifier)
 	if err != nil {
-		if os.IsExist(err) {
-			fmt.Printf("! %s already exists; cannot overwrite\n", path)
-		} else if os.IsPermission(err) {
-			fmt.Printf("! Insufficient permissions to open %s\n", path)
-		} else {
-			fmt.Println(err)
-		}
-		return
+		return err
+	}
+	if !exists {
+		return ErrEntryNotFound
 	}
-	defer f.Close()
 
 	// Get the metadata first.
-	lenData := MetaGetLength("length", rootIdentifier, masterKey)
-
-	// Start the progress bar object.
-	bar := pb.New64(lenData).Prefix("+ Exporting ")
-	bar.ShowSpeed = true
-	bar.SetUnits(pb.U_BYTES)
-	bar.Start()
+	meta, version, err := metaGet(db, format, rootIdentifier, masterKey)
+	if err != nil {
+		return err
+	}
 
-	// Grab the data.
-	for n := new(uint64); true; *n++ {
-		// Derive derived_identifier[n]
-		ct := coffer.Retrieve(crypto.DeriveIdentifierN(rootIdentifier, *n))
-		if ct == nil {
-			// This one doesn't exist. //EOF
-			break
+	// Read ahead until a chunk is missing, and decrypt several chunks at once.
+	var totalExportedBytes int64
+	var ended bool
+	hash, _ := blake2b.New256(nil)
+	produce := func(n uint64) (*chunk, error) {
+		ct, err := db.Retrieve(crypto.DeriveIdentifierN(rootIdentifier, n))
+		if err != nil || ct == nil {
+			return nil, err
 		}
+		return &chunk{data: ct}, nil
+	}
+	process := func(c *chunk) {
+		c.data, c.final, c.err = openChunk(format, c.data, version, crypto.DomainData, c.n, rootIdentifier, masterKey)
+	}
+	consume := func(c *chunk) error {
+		defer memguard.WipeBytes(c.data)
 
-		// Decrypt this slice.
-		pt, err := crypto.Decrypt(ct, masterKey)
-		if err != nil {
-			fmt.Println(err)
-			return
+		// Nothing may follow the final chunk.
+		if ended {
+			return ErrEntryTruncated
 		}
-
-		// Unpad this slice and wipe old one.
-		unpadded, e := crypto.Unpad(pt)
-		if e != nil {
-			fmt.Println(e)
-			return
+		if c.err != nil {
+			return c.err
 		}
-		bar.Add(len(unpadded)) // Increment the progress bar.
-		memguard.WipeBytes(pt)
+		ended = c.final
+		totalExportedBytes += int64(len(c.data))
+		hash.Write(c.data)
 
 		// Write and wipe data.
-		f.Write(unpadded)
-		memguard.WipeBytes(unpadded)
+		_, err := w.Write(c.data)
+		return err
+	}
+	discard := func(c *chunk) {
+		memguard.WipeBytes(c.data)
+	}
+	if err := runPipeline(format.buffers(), produce, process, consume, discard); err != nil {
+		return err
+	}
+
+	// Only old entries may end without a final chunk.
+	if version != Version1 && !ended {
+		return ErrEntryTruncated
 	}
-	// We're done. End the progress bar.
-	bar.FinishPrint(fmt.Sprintf("+ Saved to %s", path))
 
 	// Compare length in metadata to actual exported length.
-	if bar.Get() != lenData {
-		fmt.Println("! Data incomplete; database may be corrupt")
+	if totalExportedBytes != meta.Length {
+		return ErrDataIncomplete
 	}
+
+	// Check the contents against the hash.
+	if meta.Hash != nil && !bytes.Equal(hash.Sum(nil), meta.Hash) {
+		return ErrHashMismatch
+	}
+
+	return nil
 }
 
-// ViewData grabs the data from coffer and writes it to stdout.
-func ViewData(rootIdentifier, masterKey *memguard.LockedBuffer) {
-	// Get the metadata first.
-	lenData := MetaGetLength("length", rootIdentifier, masterKey)
+// RemoveData removes data from coffer. Either the whole entry is removed or, if something
+// goes wrong, none of it is.
+func RemoveData(db coffer.Backend, rootIdentifier *memguard.LockedBuffer) error {
+	// Check if this entry exists.
+	exists, err := Exists(db, rootIdentifier)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrEntryNotFound
+	}
 
-	fmt.Println("\n-----BEGIN PLAINTEXT-----")
+	// Group every deletion into a single transaction.
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Discard()
 
-	var totalExportedBytes int64
-	for n := new(uint64); true; *n++ {
-		// Derive derived_identifier[n]
-		ct := coffer.Retrieve(crypto.DeriveIdentifierN(rootIdentifier, *n))
-		if ct == nil {
-			// This one doesn't exist. //EOF
-			break
+	if err := removeEntry(tx, rootIdentifier); err != nil {
+		return err
+	}
+
+	// Apply everything at once.
+	return tx.Commit()
+}
+
+// MigrateData re-encrypts an entry stored under an older protocol version so that it is
+// stored under the current one. Either the whole entry is migrated or none of it is;
+// entries that are already current are left alone.
+func MigrateData(db coffer.Backend, format *Format, rootIdentifier, masterKey *memguard.LockedBuffer) error {
+	// Check if this entry exists.
+	exists, err := Exists(db, rootIdentifier)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrEntryNotFound
+	}
+
+	version, err := EntryVersion(db, format, rootIdentifier, masterKey)
+	if err != nil {
+		return err
+	}
+	if version == Version2 {
+		return nil
+	}
+
+	return RekeyData(db, format, rootIdentifier, masterKey, rootIdentifier, masterKey)
+}
+
+// RekeyData moves an entry from one pair of keys to another, re-encrypting it under the
+// current protocol version on the way. The keys may be the same, in which case the entry
+// is re-encrypted in place. Either the whole entry is moved or none of it is.
+func RekeyData(db coffer.Backend, format *Format, rootIdentifier, masterKey, newRootIdentifier, newMasterKey *memguard.LockedBuffer) error {
+	// Check if this entry exists.
+	exists, err := Exists(db, rootIdentifier)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrEntryNotFound
+	}
+
+	// Don't move it on top of another entry.
+	if !bytes.Equal(rootIdentifier.Buffer, newRootIdentifier.Buffer) {
+		exists, err := Exists(db, newRootIdentifier)
+		if err != nil {
+			return err
 		}
+		if exists {
+			return ErrEntryExists
+		}
+	}
+
+	metaObj, version, err := metaRetrieve(db, format, rootIdentifier, masterKey)
+	if err != nil {
+		return err
+	}
 
-		// Decrypt this slice.
-		pt, err := crypto.Decrypt(ct, masterKey)
+	// Group every write into a single transaction.
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Discard()
+
+	// Remove the old entry first. The chunks are still read from the database, which
+	// doesn't see this until it is committed.
+	if err := removeEntry(tx, rootIdentifier); err != nil {
+		return err
+	}
+
+	// Re-encrypt the pieces.
+	for n := uint64(0); true; n++ {
+		chunk, _, err := retrieveChunk(db, format, version, n, rootIdentifier, masterKey)
 		if err != nil {
-			fmt.Println(err)
-			return
+			return err
+		}
+		if chunk == nil {
+			// Old entries ending in a full chunk need an empty final one. Newer ones
+			// can only be missing it if they've been tampered with.
+			if version != Version1 {
+				return ErrEntryTruncated
+			}
+			chunk = []byte{}
 		}
 
-		// Unpad this slice and wipe old one.
-		unpadded, e := crypto.Unpad(pt)
-		if e != nil {
-			fmt.Println(e)
-			return
+		final := len(chunk) < format.dataSize()
+		ciphertext, err := sealChunk(format, chunk, crypto.DomainData, n, final, newRootIdentifier, newMasterKey)
+		memguard.WipeBytes(chunk)
+		if err != nil {
+			return err
+		}
+		if err := tx.Save(crypto.DeriveIdentifierN(newRootIdentifier, n), ciphertext); err != nil {
+			return err
 		}
-		totalExportedBytes += int64(len(unpadded))
-		memguard.WipeBytes(pt)
 
-		// Write and wipe data.
-		fmt.Print(string(unpadded))
-		memguard.WipeBytes(unpadded)
+		if final {
+			break
+		}
 	}
 
-	fmt.Println("-----END PLAINTEXT-----")
-
-	// Compare length in metadata to actual exported length.
-	if totalExportedBytes != lenData {
-		fmt.Println("! Data incomplete; database may be corrupt")
+	// Rewrite the metadata.
+	if err := MetaSaveData(tx, format, metaObj, newRootIdentifier, newMasterKey); err != nil {
+		return err
 	}
+
+	// Apply everything at once.
+	return tx.Commit()
 }
 
-// RemoveData removes data from coffer.
-func RemoveData(rootIdentifier, masterKey *memguard.LockedBuffer) {
-	// Get the metadata first.
-	lenData := MetaGetLength("length", rootIdentifier, masterKey)
+// CountChunks returns how many values, data and metadata chunks together, are stored
+// for an entry. Only the root identifier is needed to find them.
+func CountChunks(db coffer.Store, rootIdentifier *memguard.LockedBuffer) (int, error) {
+	var count int
+	for n := -1; true; n-- {
+		exists, err := db.Exists(crypto.DeriveMetaIdentifierN(rootIdentifier, n))
+		if err != nil {
+			return 0, err
+		}
+		if !exists {
+			break
+		}
+		count++
+	}
+	for n := uint64(0); true; n++ {
+		exists, err := db.Exists(crypto.DeriveIdentifierN(rootIdentifier, n))
+		if err != nil {
+			return 0, err
+		}
+		if !exists {
+			break
+		}
+		count++
+	}
 
-	// Start the progress bar.
-	bar := pb.New64(int64(math.Ceil(float64(lenData) / 4096))).Prefix("+ Removing ")
-	bar.ShowCounters = false
-	bar.SetUnits(pb.U_NO)
-	bar.Start()
+	return count, nil
+}
 
+// removeEntry deletes every chunk of an entry as part of a transaction.
+func removeEntry(tx coffer.Transaction, rootIdentifier *memguard.LockedBuffer) error {
 	// Remove all metadata.
-	MetaRemoveData(rootIdentifier)
+	if err := MetaRemoveData(tx, rootIdentifier); err != nil {
+		return err
+	}
 
 	// Delete all the pieces.
-	count := 0
 	for n := new(uint64); true; *n++ {
 		// Get the DeriveIdentifierN for this n.
 		derivedIdentifierN := crypto.DeriveIdentifierN(rootIdentifier, *n)
 
 		// Check if it exists.
-		if coffer.Exists(derivedIdentifierN) {
-			coffer.Delete(derivedIdentifierN)
-			count++
-		} else {
+		exists, err := tx.Exists(derivedIdentifierN)
+		if err != nil {
+			return err
+		}
+		if !exists {
 			break
 		}
 
-		// Increment progress bar.
-		bar.Increment()
+		if err := tx.Delete(derivedIdentifierN); err != nil {
+			return err
+		}
 	}
-	// We're done. End the progress bar.
-	bar.FinishPrint("+ Successfully removed data.")
+
+	return nil
+}
+
+// retrieveChunk returns the unpadded plaintext of chunk n of an entry stored under the
+// given protocol version, or nil if there is no such chunk, and whether it is the final
+// chunk.
+func retrieveChunk(db coffer.Store, format *Format, version int, n uint64, rootIdentifier, masterKey *memguard.LockedBuffer) ([]byte, bool, error) {
+	// Derive derived_identifier[n]
+	ct, err := db.Retrieve(crypto.DeriveIdentifierN(rootIdentifier, n))
+	if err != nil || ct == nil {
+		return nil, false, err
+	}
+
+	return openChunk(format, ct, version, crypto.DomainData, n, rootIdentifier, masterKey)
 }
@@ -0,0 +1,263 @@
+package data
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/awnumar/dissident/coffer"
+	"github.com/awnumar/dissident/crypto"
+	"github.com/awnumar/memguard"
+	"golang.org/x/crypto/blake2b"
+)
+
+func testKeys(t testing.TB) (rootIdentifier, masterKey *memguard.LockedBuffer) {
+	values, err := crypto.GenerateRandomBytes(64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootIdentifier, _ = memguard.NewFromBytes(values[:32], false)
+	masterKey, _ = memguard.NewFromBytes(values[32:], false)
+	return
+}
+
+func TestImportExportData(t *testing.T) {
+	// Spans three chunks.
+	plaintext, _ := crypto.GenerateRandomBytes(10000)
+
+	db := coffer.NewMemory()
+	rootIdentifier, masterKey := testKeys(t)
+
+	if err := ImportData(db, nil, bytes.NewReader(plaintext), nil, rootIdentifier, masterKey); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	if db.Len() != 4 {
+		t.Error("Expected 3 data chunks and 1 metadata chunk; got", db.Len())
+	}
+	if count, err := CountChunks(db, rootIdentifier); err != nil || count != 4 {
+		t.Error("Expected to count 4 chunks; got", count, err)
+	}
+	if l, err := MetaGetLength(db, nil, rootIdentifier, masterKey); err != nil || l != int64(len(plaintext)) {
+		t.Error("Expected length", len(plaintext), "; got", l, err)
+	}
+
+	// Importing over the top of it must fail.
+	if err := ImportData(db, nil, bytes.NewReader(plaintext), nil, rootIdentifier, masterKey); err != ErrEntryExists {
+		t.Error("Expected ErrEntryExists; got", err)
+	}
+
+	var exported bytes.Buffer
+	if err := ExportData(db, nil, &exported, rootIdentifier, masterKey); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if !bytes.Equal(exported.Bytes(), plaintext) {
+		t.Error("Exported data != imported data")
+	}
+
+	if err := RemoveData(db, rootIdentifier); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if db.Len() != 0 {
+		t.Error("Expected coffer to be empty; got", db.Len())
+	}
+
+	if err := ExportData(db, nil, &exported, rootIdentifier, masterKey); err != ErrEntryNotFound {
+		t.Error("Expected ErrEntryNotFound; got", err)
+	}
+	if err := RemoveData(db, rootIdentifier); err != ErrEntryNotFound {
+		t.Error("Expected ErrEntryNotFound; got", err)
+	}
+}
+
+func TestImportDataFailure(t *testing.T) {
+	db := coffer.NewMemory()
+	rootIdentifier, masterKey := testKeys(t)
+
+	// Fail part-way through, after a few chunks have been written.
+	plaintext, _ := crypto.GenerateRandomBytes(10000)
+	failure := errors.New("read failed")
+	r := io.MultiReader(bytes.NewReader(plaintext), &failingReader{failure})
+
+	if err := ImportData(db, nil, r, nil, rootIdentifier, masterKey); err != failure {
+		t.Error("Expected read error; got", err)
+	}
+	if db.Len() != 0 {
+		t.Error("Expected failed import to leave the coffer untouched; got", db.Len(), "entries")
+	}
+}
+
+func TestExportDataCorrupt(t *testing.T) {
+	db := coffer.NewMemory()
+	rootIdentifier, masterKey := testKeys(t)
+
+	plaintext, _ := crypto.GenerateRandomBytes(10000)
+	if err := ImportData(db, nil, bytes.NewReader(plaintext), nil, rootIdentifier, masterKey); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	// Drop the last chunk.
+	db.Delete(crypto.DeriveIdentifierN(rootIdentifier, 2))
+	if err := ExportData(db, nil, new(bytes.Buffer), rootIdentifier, masterKey); err != ErrEntryTruncated {
+		t.Error("Expected ErrEntryTruncated; got", err)
+	}
+
+	// Corrupt the first chunk.
+	ct, _ := db.Retrieve(crypto.DeriveIdentifierN(rootIdentifier, 0))
+	ct[100] ^= 1
+	db.Save(crypto.DeriveIdentifierN(rootIdentifier, 0), ct)
+	if err := ExportData(db, nil, new(bytes.Buffer), rootIdentifier, masterKey); err != crypto.ErrDecryptionFailed {
+		t.Error("Expected ErrDecryptionFailed; got", err)
+	}
+
+	// Remove the metadata.
+	tx, _ := db.Begin()
+	MetaRemoveData(tx, rootIdentifier)
+	tx.Commit()
+	if _, err := MetaGetLength(db, nil, rootIdentifier, masterKey); err != ErrMetadataMissing {
+		t.Error("Expected ErrMetadataMissing; got", err)
+	}
+}
+
+type failingReader struct {
+	err error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+func TestMetadata(t *testing.T) {
+	db := coffer.NewMemory()
+	rootIdentifier, masterKey := testKeys(t)
+
+	modTime := time.Date(2017, 6, 1, 12, 0, 0, 5, time.UTC)
+	in := &Metadata{Length: 100, Directory: true, Name: "project", Mode: 0750, ModTime: modTime}
+	if err := ImportData(db, nil, bytes.NewReader([]byte("tar")), in, rootIdentifier, masterKey); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	meta, err := MetaGet(db, nil, rootIdentifier, masterKey)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	hash := blake2b.Sum256([]byte("tar"))
+	if meta.Length != 3 || !meta.Directory || meta.Name != "project" || meta.Mode != 0750 || !meta.ModTime.Equal(modTime) {
+		t.Errorf("Unexpected metadata: %+v", meta)
+	}
+	if meta.MIME == "" || meta.Created.IsZero() || !bytes.Equal(meta.Hash, hash[:]) {
+		t.Errorf("Expected MIME type, creation time and hash to be filled in: %+v", meta)
+	}
+
+	// Tampering with the hash is noticed on export.
+	tx, _ := db.Begin()
+	meta.Hash[0] ^= 1
+	if err := MetaSet(tx, nil, meta, rootIdentifier, masterKey); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	tx.Commit()
+	if err := ExportData(db, nil, ioutil.Discard, rootIdentifier, masterKey); err != ErrHashMismatch {
+		t.Error("Expected ErrHashMismatch; got", err)
+	}
+}
+
+func TestMetadataChunks(t *testing.T) {
+	db := coffer.NewMemory()
+	rootIdentifier, masterKey := testKeys(t)
+
+	// A name long enough to need three metadata chunks.
+	name := strings.Repeat("n", 9000)
+	if err := ImportData(db, nil, bytes.NewReader(nil), &Metadata{Name: name}, rootIdentifier, masterKey); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if db.Len() != 4 {
+		t.Error("Expected 1 data chunk and 3 metadata chunks; got", db.Len())
+	}
+
+	meta, err := MetaGet(db, nil, rootIdentifier, masterKey)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if meta.Name != name {
+		t.Error("Name was not stored intact; got length", len(meta.Name))
+	}
+}
+
+func TestFormatSuites(t *testing.T) {
+	plaintext, _ := crypto.GenerateRandomBytes(10000)
+
+	for _, suite := range []crypto.Suite{crypto.XSalsa20Poly1305, crypto.XChaCha20Poly1305, crypto.AES256GCMSIV} {
+		db := coffer.NewMemory()
+		rootIdentifier, masterKey := testKeys(t)
+		format := &Format{Suite: suite}
+
+		if err := ImportData(db, format, bytes.NewReader(plaintext), nil, rootIdentifier, masterKey); err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+
+		// Every chunk is the same size.
+		for n := uint64(0); n < 3; n++ {
+			if ct, _ := db.Retrieve(crypto.DeriveIdentifierN(rootIdentifier, n)); len(ct) != 4096+suite.Overhead() {
+				t.Error(suite, "chunk", n, "has length", len(ct))
+			}
+		}
+
+		var exported bytes.Buffer
+		if err := ExportData(db, format, &exported, rootIdentifier, masterKey); err != nil || !bytes.Equal(exported.Bytes(), plaintext) {
+			t.Error(suite, "failed to export:", err)
+		}
+
+		// Nothing can be read with the wrong suite.
+		wrong := &Format{Suite: crypto.XChaCha20Poly1305}
+		if suite == crypto.XChaCha20Poly1305 {
+			wrong = nil
+		}
+		if err := ExportData(db, wrong, ioutil.Discard, rootIdentifier, masterKey); err != crypto.ErrDecryptionFailed {
+			t.Error(suite, "expected ErrDecryptionFailed; got", err)
+		}
+	}
+}
+
+func TestFormatChunkSize(t *testing.T) {
+	plaintext, _ := crypto.GenerateRandomBytes(10000)
+	db := coffer.NewMemory()
+	rootIdentifier, masterKey := testKeys(t)
+	format := &Format{ChunkSize: 1024}
+
+	if err := ImportData(db, format, bytes.NewReader(plaintext), nil, rootIdentifier, masterKey); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	// Every chunk, metadata included, is padded to the chunk size.
+	chunks := len(plaintext)/1023 + 1
+	for n := uint64(0); n < uint64(chunks); n++ {
+		if ct, _ := db.Retrieve(crypto.DeriveIdentifierN(rootIdentifier, n)); len(ct) != 1024+40 {
+			t.Error("Chunk", n, "has length", len(ct))
+		}
+	}
+	if ct, _ := db.Retrieve(crypto.DeriveMetaIdentifierN(rootIdentifier, -1)); len(ct) != 1024+40 {
+		t.Error("Metadata chunk has length", len(ct))
+	}
+	if db.Len() != chunks+1 {
+		t.Errorf("Expected %d data chunks and 1 metadata chunk; got %d", chunks, db.Len())
+	}
+
+	var exported bytes.Buffer
+	if err := ExportData(db, format, &exported, rootIdentifier, masterKey); err != nil || !bytes.Equal(exported.Bytes(), plaintext) {
+		t.Error("Failed to export:", err)
+	}
+
+	// Random access finds the right chunks.
+	r, err := NewReader(db, format, rootIdentifier, masterKey)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	part := make([]byte, 3000)
+	if _, err := r.ReadAt(part, 5000); err != nil || !bytes.Equal(part, plaintext[5000:8000]) {
+		t.Error("Failed to read at an offset:", err)
+	}
+}
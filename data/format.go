@@ -0,0 +1,76 @@
+package data
+
+import (
+	"errors"
+
+	"github.com/awnumar/dissident/crypto"
+)
+
+// Chunk sizes, in bytes, before encryption.
+const (
+	// DefaultChunkSize is the size of the chunks in vaults that don't choose one.
+	DefaultChunkSize = 4096
+
+	// MinChunkSize and MaxChunkSize bound the chunk sizes a vault may choose.
+	MinChunkSize = 1 << 10
+	MaxChunkSize = 16 << 20
+)
+
+// ErrInvalidChunkSize is returned for chunk sizes outside MinChunkSize and MaxChunkSize.
+var ErrInvalidChunkSize = errors.New("! Chunk size must be between 1 KiB and 16 MiB")
+
+// Format describes how the chunks of an entry are encrypted. Every entry in a vault
+// uses the same format, so that all of its chunks look alike. A nil Format is the one
+// vaults have always used.
+type Format struct {
+	// Suite encrypts every chunk. If it is nil, crypto.XSalsa20Poly1305 is used.
+	Suite crypto.Suite
+
+	// ChunkSize is how many bytes every chunk is padded to before it is encrypted. Each
+	// one holds up to a byte less than this of data. If it is zero, DefaultChunkSize is
+	// used.
+	ChunkSize int
+
+	// Buffers is how many chunks may be in memory at once while an entry is imported or
+	// exported, and so how many are encrypted or decrypted in parallel. It isn't part
+	// of what is stored, and can differ between machines. If it is zero, DefaultBuffers
+	// is used; one handles a chunk at a time.
+	Buffers int
+}
+
+// CheckChunkSize returns ErrInvalidChunkSize if size is too small or too large.
+func CheckChunkSize(size int) error {
+	if size < MinChunkSize || size > MaxChunkSize {
+		return ErrInvalidChunkSize
+	}
+	return nil
+}
+
+// suite returns the cipher suite that chunks are encrypted with.
+func (f *Format) suite() crypto.Suite {
+	if f == nil || f.Suite == nil {
+		return crypto.XSalsa20Poly1305
+	}
+	return f.Suite
+}
+
+// chunkSize returns the size chunks are padded to.
+func (f *Format) chunkSize() int {
+	if f == nil || f.ChunkSize == 0 {
+		return DefaultChunkSize
+	}
+	return f.ChunkSize
+}
+
+// dataSize returns how much data each full chunk holds.
+func (f *Format) dataSize() int {
+	return f.chunkSize() - 1
+}
+
+// buffers returns how many chunks may be in flight at once.
+func (f *Format) buffers() int {
+	if f == nil || f.Buffers < 1 {
+		return DefaultBuffers
+	}
+	return f.Buffers
+}
@@ -1,7 +1,10 @@
 package data
 
 import (
-	"fmt"
+	"encoding/hex"
+	"errors"
+	"os"
+	"time"
 
 	"github.com/Jeffail/gabs"
 	"github.com/awnumar/dissident/coffer"
@@ -10,115 +13,242 @@ import (
 )
 
 var (
-	metaObj *gabs.Container
+	// ErrMetadataMissing is returned when an entry has no length recorded in its metadata.
+	ErrMetadataMissing = errors.New("! No length field found; was importing interrupted?")
+
+	// ErrMetadataInvalid is returned when a metadata field can't be parsed.
+	ErrMetadataInvalid = errors.New("! Invalid metadata; database may be corrupt")
 )
 
-// MetaSetLength sets the length field of an entry to the supplied value.
-func MetaSetLength(length int64, rootIdentifier, masterKey *memguard.LockedBuffer) {
-	metaObj = gabs.New()
-	metaObj.SetP(length, "length")
-	MetaSaveData(rootIdentifier, masterKey)
+// Metadata is what is known about an entry besides its contents.
+type Metadata struct {
+	// Length is the length of the entry's data in bytes.
+	Length int64
+
+	// Directory is true if the data is a tar stream of a directory tree.
+	Directory bool
+
+	// Name is the base name of the file or directory the data was imported from.
+	Name string
+
+	// Mode holds the permission bits of the original file or directory.
+	Mode os.FileMode
+
+	// ModTime is when the original was last modified.
+	ModTime time.Time
+
+	// MIME is the media type of the data.
+	MIME string
+
+	// Created is when the entry was imported.
+	Created time.Time
+
+	// Hash is the BLAKE2b-256 hash of the data.
+	Hash []byte
 }
 
-// MetaGetLength retrieves the length of this data and returns it.
-func MetaGetLength(path string, rootIdentifier, masterKey *memguard.LockedBuffer) int64 {
-	metaObj = gabs.New()
+// MetaSet saves the metadata of an entry as part of a transaction.
+func MetaSet(tx coffer.Transaction, format *Format, meta *Metadata, rootIdentifier, masterKey *memguard.LockedBuffer) error {
+	metaObj := gabs.New()
+	metaObj.SetP(meta.Length, "length")
+	if meta.Directory {
+		metaObj.SetP(true, "directory")
+	}
+	if meta.Name != "" {
+		metaObj.SetP(meta.Name, "name")
+	}
+	if meta.Mode != 0 {
+		metaObj.SetP(uint32(meta.Mode), "mode")
+	}
+	if !meta.ModTime.IsZero() {
+		metaObj.SetP(meta.ModTime.Format(time.RFC3339Nano), "modtime")
+	}
+	if meta.MIME != "" {
+		metaObj.SetP(meta.MIME, "mime")
+	}
+	if !meta.Created.IsZero() {
+		metaObj.SetP(meta.Created.Format(time.RFC3339Nano), "created")
+	}
+	if meta.Hash != nil {
+		metaObj.SetP(hex.EncodeToString(meta.Hash), "hash")
+	}
+
+	return MetaSaveData(tx, format, metaObj, rootIdentifier, masterKey)
+}
+
+// MetaGet retrieves the metadata of an entry.
+func MetaGet(db coffer.Store, format *Format, rootIdentifier, masterKey *memguard.LockedBuffer) (*Metadata, error) {
+	meta, _, err := metaGet(db, format, rootIdentifier, masterKey)
+	return meta, err
+}
+
+// metaGet is MetaGet, but also returns the protocol version of the entry.
+func metaGet(db coffer.Store, format *Format, rootIdentifier, masterKey *memguard.LockedBuffer) (*Metadata, int, error) {
+	metaObj, version, err := metaRetrieve(db, format, rootIdentifier, masterKey)
+	if err != nil {
+		return nil, 0, err
+	}
+	meta, err := parseMetadata(metaObj)
+	return meta, version, err
+}
+
+// parseMetadata reads the fields of a metadata object.
+func parseMetadata(metaObj *gabs.Container) (*Metadata, error) {
+	length, ok := metaObj.Path("length").Data().(float64)
+	if !ok {
+		return nil, ErrMetadataMissing
+	}
+	meta := &Metadata{Length: int64(length)}
+	meta.Directory, _ = metaObj.Path("directory").Data().(bool)
+	meta.Name, _ = metaObj.Path("name").Data().(string)
+	meta.MIME, _ = metaObj.Path("mime").Data().(string)
+	if mode, ok := metaObj.Path("mode").Data().(float64); ok {
+		meta.Mode = os.FileMode(mode)
+	}
+
+	// Entries imported by older versions won't have the rest.
+	var err error
+	if meta.ModTime, err = metaTime(metaObj, "modtime"); err != nil {
+		return nil, err
+	}
+	if meta.Created, err = metaTime(metaObj, "created"); err != nil {
+		return nil, err
+	}
+	if hash, ok := metaObj.Path("hash").Data().(string); ok {
+		if meta.Hash, err = hex.DecodeString(hash); err != nil {
+			return nil, ErrMetadataInvalid
+		}
+	}
 
-	MetaRetrieveData(rootIdentifier, masterKey)
+	return meta, nil
+}
+
+// metaTime parses the timestamp stored under path, if there is one.
+func metaTime(metaObj *gabs.Container, path string) (time.Time, error) {
+	value, ok := metaObj.Path(path).Data().(string)
+	if !ok {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, ErrMetadataInvalid
+	}
+	return t, nil
+}
 
-	value := metaObj.Path(path).Data()
-	if value == nil {
-		fmt.Println("! No length field found; was importing interrupted?")
-		memguard.SafeExit(1)
+// MetaGetLength retrieves the length of this data and returns it.
+func MetaGetLength(db coffer.Store, format *Format, rootIdentifier, masterKey *memguard.LockedBuffer) (int64, error) {
+	meta, err := MetaGet(db, format, rootIdentifier, masterKey)
+	if err != nil {
+		return 0, err
 	}
 
-	return int64(value.(float64))
+	return meta.Length, nil
 }
 
-// MetaSaveData saves the metadata to the database.
-func MetaSaveData(rootIdentifier, masterKey *memguard.LockedBuffer) {
-	// Grab the metadata as bytes.
-	data := []byte(metaObj.String())
-
-	var chunk []byte
-	for i := 0; i < len(data); i += 4095 {
-		if i+4095 > len(data) {
-			// Remaining data <= 4095.
-			chunk = data[len(data)-(len(data)%4095):]
-		} else {
-			// Split into chunks of 4095 bytes and pad.
-			chunk = data[i : i+4095]
+// MetaSaveData saves the metadata as part of a transaction.
+func MetaSaveData(tx coffer.Transaction, format *Format, metaObj *gabs.Container, rootIdentifier, masterKey *memguard.LockedBuffer) error {
+	// Grab the metadata as bytes, and wipe them once they are encrypted.
+	data := metaObj.Bytes()
+	defer memguard.WipeBytes(data)
+
+	size := format.dataSize()
+	for i := 0; i < len(data); i += size {
+		// Split into chunks no larger than the data a chunk holds.
+		end := i + size
+		if end > len(data) {
+			end = len(data)
 		}
+		chunk := data[i:end]
 
-		// Pad the chunk to standard size.
-		padded, err := crypto.Pad(chunk, 4096)
+		// Pad and encrypt it.
+		ciphertext, err := sealChunk(format, chunk, crypto.DomainMeta, uint64(i/size), end == len(data), rootIdentifier, masterKey)
 		if err != nil {
-			fmt.Println(err)
-			memguard.SafeExit(1)
+			return err
 		}
 
 		// Save it to the database.
-		coffer.Save(crypto.DeriveMetaIdentifierN(rootIdentifier, -i-1), crypto.Encrypt(padded, masterKey))
+		if err := tx.Save(crypto.DeriveMetaIdentifierN(rootIdentifier, -(i/size)-1), ciphertext); err != nil {
+			return err
+		}
 	}
+
+	return nil
+}
+
+// MetaRetrieveData gets the metadata from the database and returns it. If there is no
+// metadata an empty object is returned.
+func MetaRetrieveData(db coffer.Store, format *Format, rootIdentifier, masterKey *memguard.LockedBuffer) (*gabs.Container, error) {
+	metaObj, _, err := metaRetrieve(db, format, rootIdentifier, masterKey)
+	return metaObj, err
 }
 
-// MetaRetrieveData gets the metadata from the database and returns
-func MetaRetrieveData(rootIdentifier, masterKey *memguard.LockedBuffer) {
+// metaRetrieve is MetaRetrieveData, but also returns the protocol version of the entry.
+func metaRetrieve(db coffer.Store, format *Format, rootIdentifier, masterKey *memguard.LockedBuffer) (*gabs.Container, int, error) {
+	version, err := EntryVersion(db, format, rootIdentifier, masterKey)
+	if err == ErrMetadataMissing {
+		// No data.
+		return gabs.New(), Version2, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
 	// Declare variable to hold all of this metadata.
 	var data []byte
 
-	for n := -1; true; n-- {
-		ct := coffer.Retrieve(crypto.DeriveMetaIdentifierN(rootIdentifier, n))
+	for n, final := -1, false; !final; n-- {
+		ct, err := db.Retrieve(crypto.DeriveMetaIdentifierN(rootIdentifier, n))
+		if err != nil {
+			return nil, 0, err
+		}
 		if ct == nil {
-			// This one doesn't exist. //EOF
+			// This one doesn't exist. Only old entries may end without a final chunk.
+			if version != Version1 {
+				return nil, 0, ErrEntryTruncated
+			}
 			break
 		}
 
-		// Decrypt this slice.
-		pt, err := crypto.Decrypt(ct, masterKey)
+		// Decrypt and unpad this slice.
+		var unpadded []byte
+		unpadded, final, err = openChunk(format, ct, version, crypto.DomainMeta, uint64(-n-1), rootIdentifier, masterKey)
 		if err != nil {
-			fmt.Println(err)
-			memguard.SafeExit(1)
-		}
-
-		// Unpad this slice.
-		unpadded, e := crypto.Unpad(pt)
-		if e != nil {
-			fmt.Println(e)
-			memguard.SafeExit(1)
+			return nil, 0, err
 		}
 
 		// Append this chunk to the metadata.
 		data = append(data, unpadded...)
 	}
 
-	if len(data) == 0 {
-		// No data.
-		return
-	}
-
-	// Set the global metadata JSON object to this data.
-	metadataObj, err := gabs.ParseJSON(data)
+	// Parse the metadata JSON object.
+	metaObj, err := gabs.ParseJSON(data)
 	if err != nil {
-		fmt.Println(err)
-		memguard.SafeExit(1)
+		return nil, 0, err
 	}
-
-	// That went well. Set the global var to that object.
-	metaObj = metadataObj
+	return metaObj, version, nil
 }
 
-// MetaRemoveData deletes all the metadata related to an entry.
-func MetaRemoveData(rootIdentifier *memguard.LockedBuffer) {
+// MetaRemoveData deletes all the metadata related to an entry as part of a transaction.
+func MetaRemoveData(tx coffer.Transaction, rootIdentifier *memguard.LockedBuffer) error {
 	for n := -1; true; n-- {
 		// Get the DeriveIdentifierN for this n.
 		derivedMetaIdentifierN := crypto.DeriveMetaIdentifierN(rootIdentifier, n)
 
 		// Check if it exists.
-		if coffer.Exists(derivedMetaIdentifierN) {
-			coffer.Delete(derivedMetaIdentifierN)
-		} else {
+		exists, err := tx.Exists(derivedMetaIdentifierN)
+		if err != nil {
+			return err
+		}
+		if !exists {
 			break
 		}
+
+		if err := tx.Delete(derivedMetaIdentifierN); err != nil {
+			return err
+		}
 	}
+
+	return nil
 }
@@ -0,0 +1,103 @@
+package data
+
+import (
+	"runtime"
+	"sync"
+)
+
+// DefaultBuffers is how many chunks are in flight at once when a Format doesn't say.
+var DefaultBuffers = 2 * runtime.NumCPU()
+
+// chunk is one chunk of an entry on its way through a pipeline.
+type chunk struct {
+	n     uint64
+	data  []byte
+	final bool
+	err   error
+	done  chan struct{}
+}
+
+// runPipeline works on several chunks of an entry at once. The chunks returned by produce
+// are passed to process on as many goroutines as there are CPUs, and then to consume, in
+// the order they were produced, on the calling goroutine. produce runs on a goroutine of
+// its own and returns nil once there are no more chunks. Errors from process are left in
+// the chunk for consume to deal with. At most buffers chunks are in flight at once.
+//
+// The first error returned by produce or consume stops the pipeline and is returned.
+// Chunks that are still in flight are passed to discard, if it isn't nil, instead of
+// consume so that they can be wiped.
+func runPipeline(buffers int, produce func(n uint64) (*chunk, error), process func(*chunk), consume func(*chunk) error, discard func(*chunk)) error {
+	if buffers < 1 {
+		buffers = 1
+	}
+	workers := runtime.GOMAXPROCS(0)
+	if workers > buffers {
+		workers = buffers
+	}
+
+	tokens := make(chan struct{}, buffers)
+	queue := make(chan *chunk, buffers)
+	work := make(chan *chunk, buffers)
+	stop := make(chan struct{})
+
+	// Produce chunks in order, waiting for room for each one.
+	var produceErr error
+	go func() {
+		defer close(queue)
+		defer close(work)
+		for n := uint64(0); ; n++ {
+			select {
+			case tokens <- struct{}{}:
+			case <-stop:
+				return
+			}
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			c, err := produce(n)
+			if err != nil || c == nil {
+				produceErr = err
+				return
+			}
+			c.n, c.done = n, make(chan struct{})
+			queue <- c
+			work <- c
+		}
+	}()
+
+	// Process them in parallel.
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range work {
+				process(c)
+				close(c.done)
+			}
+		}()
+	}
+
+	// Consume them in order, and discard the rest if anything goes wrong.
+	var err error
+	for c := range queue {
+		<-c.done
+		if err == nil {
+			if err = consume(c); err != nil {
+				close(stop)
+			}
+		} else if discard != nil {
+			discard(c)
+		}
+		<-tokens
+	}
+	wg.Wait()
+
+	if err == nil {
+		err = produceErr
+	}
+	return err
+}
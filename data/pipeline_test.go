@@ -0,0 +1,165 @@
+package data
+
+import (
+	"bytes"
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	"github.com/awnumar/dissident/coffer"
+	"github.com/awnumar/dissident/crypto"
+)
+
+func TestRunPipeline(t *testing.T) {
+	for _, buffers := range []int{0, 1, 3, 16} {
+		var inFlight, peak int32
+		var consumed []uint64
+		produce := func(n uint64) (*chunk, error) {
+			if n == 100 {
+				return nil, nil
+			}
+			if f := atomic.AddInt32(&inFlight, 1); f > atomic.LoadInt32(&peak) {
+				atomic.StoreInt32(&peak, f)
+			}
+			return &chunk{data: []byte{byte(n)}}, nil
+		}
+		process := func(c *chunk) {
+			c.data[0]++
+		}
+		consume := func(c *chunk) error {
+			if c.data[0] != byte(c.n+1) {
+				t.Error("Chunk", c.n, "was not processed")
+			}
+			consumed = append(consumed, c.n)
+			atomic.AddInt32(&inFlight, -1)
+			return nil
+		}
+		if err := runPipeline(buffers, produce, process, consume, nil); err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+
+		// Every chunk is consumed, in order.
+		if len(consumed) != 100 {
+			t.Error("Expected 100 chunks; got", len(consumed))
+		}
+		for i, n := range consumed {
+			if n != uint64(i) {
+				t.Error("Chunk", n, "was consumed at position", i)
+				break
+			}
+		}
+		limit := int32(buffers)
+		if limit < 1 {
+			limit = 1
+		}
+		if peak > limit {
+			t.Error("Expected at most", limit, "chunks in flight; got", peak)
+		}
+	}
+}
+
+func TestRunPipelineErrors(t *testing.T) {
+	failure := errors.New("failed")
+	produce := func(n uint64) (*chunk, error) {
+		if n == 1000 {
+			return nil, nil
+		}
+		return &chunk{}, nil
+	}
+
+	// The first error from consume stops everything, and the rest are discarded.
+	var consumed, discarded int
+	consume := func(c *chunk) error {
+		consumed++
+		if c.n == 10 {
+			return failure
+		}
+		return nil
+	}
+	discard := func(c *chunk) {
+		discarded++
+	}
+	if err := runPipeline(4, produce, func(*chunk) {}, consume, discard); err != failure {
+		t.Error("Expected consume error; got", err)
+	}
+	if consumed != 11 || discarded > 4 {
+		t.Error("Expected 11 chunks consumed and no more than 4 discarded; got", consumed, discarded)
+	}
+
+	// So does an error from produce, once the chunks before it are consumed.
+	consumed = 0
+	produce = func(n uint64) (*chunk, error) {
+		if n == 10 {
+			return nil, failure
+		}
+		return &chunk{}, nil
+	}
+	if err := runPipeline(4, produce, func(*chunk) {}, func(*chunk) error { consumed++; return nil }, nil); err != failure {
+		t.Error("Expected produce error; got", err)
+	}
+	if consumed != 10 {
+		t.Error("Expected 10 chunks consumed; got", consumed)
+	}
+}
+
+func TestImportExportBuffers(t *testing.T) {
+	plaintext, _ := crypto.GenerateRandomBytes(100000)
+
+	// However many chunks are in flight, the result is the same.
+	for _, buffers := range []int{1, 2, 64} {
+		db := coffer.NewMemory()
+		rootIdentifier, masterKey := testKeys(t)
+		format := &Format{Buffers: buffers}
+
+		if err := ImportData(db, format, bytes.NewReader(plaintext), nil, rootIdentifier, masterKey); err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		var exported bytes.Buffer
+		if err := ExportData(db, nil, &exported, rootIdentifier, masterKey); err != nil || !bytes.Equal(exported.Bytes(), plaintext) {
+			t.Error("Failed to export with", buffers, "buffers:", err)
+		}
+		exported.Reset()
+		if err := ExportData(db, format, &exported, rootIdentifier, masterKey); err != nil || !bytes.Equal(exported.Bytes(), plaintext) {
+			t.Error("Failed to export with", buffers, "buffers:", err)
+		}
+	}
+}
+
+func BenchmarkImportData(b *testing.B) {
+	benchmarkPipeline(b, false)
+}
+
+func BenchmarkExportData(b *testing.B) {
+	benchmarkPipeline(b, true)
+}
+
+func benchmarkPipeline(b *testing.B, export bool) {
+	plaintext, _ := crypto.GenerateRandomBytes(4 << 20)
+	for _, buffers := range []int{1, DefaultBuffers} {
+		format := &Format{Buffers: buffers}
+		name := "sequential"
+		if buffers > 1 {
+			name = "parallel"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(plaintext)))
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				db := coffer.NewMemory()
+				rootIdentifier, masterKey := testKeys(b)
+				if !export {
+					b.StartTimer()
+				}
+				if err := ImportData(db, format, bytes.NewReader(plaintext), nil, rootIdentifier, masterKey); err != nil {
+					b.Fatal(err)
+				}
+				if export {
+					b.StartTimer()
+					if err := ExportData(db, format, &bytes.Buffer{}, rootIdentifier, masterKey); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
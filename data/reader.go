@@ -0,0 +1,132 @@
+package data
+
+import (
+	"errors"
+	"io"
+
+	"github.com/awnumar/dissident/coffer"
+	"github.com/awnumar/memguard"
+)
+
+// Reader provides random access to the data stored in an entry. Every chunk holds
+// exactly as much data as the format allows except the last, so only the chunks covering the bytes
+// that are asked for have to be decrypted.
+//
+// The keys passed to NewReader are used directly, and must not be destroyed while the
+// Reader is in use.
+type Reader struct {
+	db             coffer.Store
+	format         *Format
+	rootIdentifier *memguard.LockedBuffer
+	masterKey      *memguard.LockedBuffer
+	version        int
+	length         int64
+	offset         int64
+}
+
+// NewReader returns a Reader over an existing entry. Its size is taken from the
+// entry's metadata.
+func NewReader(db coffer.Store, format *Format, rootIdentifier, masterKey *memguard.LockedBuffer) (*Reader, error) {
+	// Check if this entry exists.
+	exists, err := Exists(db, rootIdentifier)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrEntryNotFound
+	}
+
+	// Get the metadata.
+	meta, version, err := metaGet(db, format, rootIdentifier, masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Reader{db: db, format: format, rootIdentifier: rootIdentifier, masterKey: masterKey, version: version, length: meta.Length}, nil
+}
+
+// Size returns the length of the entry.
+func (r *Reader) Size() int64 {
+	return r.length
+}
+
+// ReadAt implements io.ReaderAt.
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("! Negative offset")
+	}
+
+	var n int
+	size := int64(r.format.dataSize())
+	for n < len(p) && off < r.length {
+		// Grab the chunk covering this offset.
+		index := off / size
+		chunk, final, err := retrieveChunk(r.db, r.format, r.version, uint64(index), r.rootIdentifier, r.masterKey)
+		if err != nil {
+			return n, err
+		}
+
+		// Only the chunk holding the end of the data may be final.
+		if r.version != Version1 && final != (index == r.length/size) {
+			memguard.WipeBytes(chunk)
+			return n, ErrEntryTruncated
+		}
+
+		// Every chunk but the last must be full.
+		expected := r.length - index*size
+		if expected > size {
+			expected = size
+		}
+		if int64(len(chunk)) != expected {
+			memguard.WipeBytes(chunk)
+			return n, ErrDataIncomplete
+		}
+
+		// Copy out the part we want and wipe the rest.
+		copied := copy(p[n:], chunk[off-index*size:])
+		memguard.WipeBytes(chunk)
+		n += copied
+		off += int64(copied)
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Read implements io.Reader.
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.offset >= r.length {
+		return 0, io.EOF
+	}
+
+	n, err := r.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		// Report EOF on the next call instead.
+		err = nil
+	}
+
+	return n, err
+}
+
+// Seek implements io.Seeker.
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.length
+	default:
+		return 0, errors.New("! Invalid whence")
+	}
+
+	if offset < 0 {
+		return 0, errors.New("! Negative position")
+	}
+	r.offset = offset
+
+	return offset, nil
+}
@@ -0,0 +1,69 @@
+package data
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/awnumar/dissident/coffer"
+	"github.com/awnumar/dissident/crypto"
+)
+
+func TestReader(t *testing.T) {
+	db := coffer.NewMemory()
+	rootIdentifier, masterKey := testKeys(t)
+
+	plaintext, _ := crypto.GenerateRandomBytes(3*4095 + 100)
+	if err := ImportData(db, nil, bytes.NewReader(plaintext), nil, rootIdentifier, masterKey); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	r, err := NewReader(db, nil, rootIdentifier, masterKey)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if r.Size() != int64(len(plaintext)) {
+		t.Error("Expected size", len(plaintext), "; got", r.Size())
+	}
+
+	// Reads within a chunk, across chunk boundaries and up to the end.
+	for _, c := range []struct{ off, n int }{{0, 10}, {4090, 10}, {4095, 4095}, {100, 3 * 4095}, {len(plaintext) - 5, 5}} {
+		p := make([]byte, c.n)
+		n, err := r.ReadAt(p, int64(c.off))
+		if err != nil || n != c.n {
+			t.Errorf("ReadAt(%d, %d): n=%d err=%v", c.off, c.n, n, err)
+		}
+		if !bytes.Equal(p, plaintext[c.off:c.off+c.n]) {
+			t.Errorf("ReadAt(%d, %d) returned the wrong data", c.off, c.n)
+		}
+	}
+
+	// Reading past the end.
+	p := make([]byte, 10)
+	n, err := r.ReadAt(p, int64(len(plaintext)-5))
+	if n != 5 || err != io.EOF {
+		t.Error("Expected 5 bytes and io.EOF; got", n, err)
+	}
+
+	// Seek to the tail and read the rest.
+	if _, err := r.Seek(-150, io.SeekEnd); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	tail, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if !bytes.Equal(tail, plaintext[len(plaintext)-150:]) {
+		t.Error("Tail != end of plaintext")
+	}
+
+	// A missing chunk in the middle is reported.
+	db.Delete(crypto.DeriveIdentifierN(rootIdentifier, 1))
+	if _, err := r.ReadAt(p, 4095); err != ErrDataIncomplete {
+		t.Error("Expected ErrDataIncomplete; got", err)
+	}
+	if _, err := r.ReadAt(p, 0); err != nil {
+		t.Error("Reading an intact chunk failed:", err)
+	}
+}
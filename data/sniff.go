@@ -0,0 +1,104 @@
+package data
+
+import (
+	"bytes"
+	"unicode/utf8"
+)
+
+// sniffLen is how much of the data sniffMIME looks at.
+const sniffLen = 512
+
+// signatures maps the bytes that files of common types start with to their types.
+var signatures = []struct {
+	prefix, mime string
+}{
+	{"%PDF-", "application/pdf"},
+	{"%!PS-Adobe-", "application/postscript"},
+	{"\x89PNG\r\n\x1a\n", "image/png"},
+	{"\xff\xd8\xff", "image/jpeg"},
+	{"GIF87a", "image/gif"},
+	{"GIF89a", "image/gif"},
+	{"BM", "image/bmp"},
+	{"\x00\x00\x01\x00", "image/x-icon"},
+	{"PK\x03\x04", "application/zip"},
+	{"\x1f\x8b\x08", "application/x-gzip"},
+	{"BZh", "application/x-bzip2"},
+	{"\xfd7zXZ\x00", "application/x-xz"},
+	{"7z\xbc\xaf\x27\x1c", "application/x-7z-compressed"},
+	{"Rar!\x1a\x07", "application/x-rar-compressed"},
+	{"\x28\xb5\x2f\xfd", "application/zstd"},
+	{"OggS\x00", "application/ogg"},
+	{"ID3", "audio/mpeg"},
+	{"fLaC", "audio/flac"},
+	{"\x1aE\xdf\xa3", "video/webm"},
+	{"\x00asm", "application/wasm"},
+	{"\x7fELF", "application/x-executable"},
+}
+
+// markup maps how markup starts, once leading white space is skipped, to its type.
+// Case is ignored.
+var markup = []struct {
+	prefix, mime string
+}{
+	{"<!doctype html", "text/html; charset=utf-8"},
+	{"<html", "text/html; charset=utf-8"},
+	{"<?xml", "text/xml; charset=utf-8"},
+	{"<svg", "image/svg+xml"},
+}
+
+// sniffMIME guesses the media type of data from the first sniffLen bytes of it. Only
+// the formats people are most likely to import are recognised; anything else is text
+// if it looks like UTF-8 text, and application/octet-stream if it doesn't.
+func sniffMIME(data []byte) string {
+	if len(data) > sniffLen {
+		data = data[:sniffLen]
+	}
+
+	for _, s := range signatures {
+		if bytes.HasPrefix(data, []byte(s.prefix)) {
+			return s.mime
+		}
+	}
+
+	// Containers named by the bytes after their size.
+	if len(data) >= 12 {
+		switch {
+		case string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+			return "image/webp"
+		case string(data[:4]) == "RIFF" && string(data[8:12]) == "WAVE":
+			return "audio/wave"
+		case string(data[4:8]) == "ftyp":
+			return "video/mp4"
+		}
+	}
+
+	trimmed := bytes.ToLower(bytes.TrimLeft(data, "\t\n\f\r "))
+	for _, m := range markup {
+		if bytes.HasPrefix(trimmed, []byte(m.prefix)) {
+			return m.mime
+		}
+	}
+
+	if isText(data) {
+		return "text/plain; charset=utf-8"
+	}
+	return "application/octet-stream"
+}
+
+// isText reports whether data looks like UTF-8 text: it has no control characters but
+// white space and escapes, and is valid UTF-8 apart from a rune cut off at the end.
+func isText(data []byte) bool {
+	for _, b := range data {
+		if b < 0x20 && b != '\t' && b != '\n' && b != '\f' && b != '\r' && b != 0x1b || b == 0x7f {
+			return false
+		}
+	}
+	for len(data) > 0 {
+		r, size := utf8.DecodeRune(data)
+		if r == utf8.RuneError && size == 1 {
+			return !utf8.FullRune(data)
+		}
+		data = data[size:]
+	}
+	return true
+}
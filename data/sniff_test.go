@@ -0,0 +1,37 @@
+package data
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSniffMIME(t *testing.T) {
+	for _, v := range []struct {
+		data, mime string
+	}{
+		{"", "text/plain; charset=utf-8"},
+		{"hello, world\n", "text/plain; charset=utf-8"},
+		{"caf\xc3\xa9 \xe2\x82", "text/plain; charset=utf-8"},
+		{"%PDF-1.7\n", "application/pdf"},
+		{"\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR", "image/png"},
+		{"\xff\xd8\xff\xe0\x00\x10JFIF", "image/jpeg"},
+		{"PK\x03\x04\x14\x00", "application/zip"},
+		{"\x1f\x8b\x08\x00\x00\x00\x00\x00", "application/x-gzip"},
+		{"RIFF\x24\x00\x00\x00WAVEfmt ", "audio/wave"},
+		{"\x00\x00\x00\x20ftypisom", "video/mp4"},
+		{"\n  <!DOCTYPE html><title>", "text/html; charset=utf-8"},
+		{"<?xml version=\"1.0\"?>", "text/xml; charset=utf-8"},
+		{"\x00\x01\x02\x03", "application/octet-stream"},
+		{"caf\xe9 au lait", "application/octet-stream"},
+	} {
+		if mime := sniffMIME([]byte(v.data)); mime != v.mime {
+			t.Errorf("Expected %s for %q; got %s", v.mime, v.data, mime)
+		}
+	}
+
+	// Only the start of the data is looked at.
+	long := append(bytes.Repeat([]byte("a"), sniffLen), 0)
+	if mime := sniffMIME(long); mime != "text/plain; charset=utf-8" {
+		t.Error("Expected text; got", mime)
+	}
+}
@@ -0,0 +1,211 @@
+package data
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/Jeffail/gabs"
+	"github.com/awnumar/dissident/coffer"
+	"github.com/awnumar/dissident/crypto"
+	"github.com/awnumar/memguard"
+	"golang.org/x/crypto/blake2b"
+)
+
+// ChunkError is a problem with a single chunk of an entry.
+type ChunkError struct {
+	// Meta is whether it is a metadata chunk rather than a data chunk.
+	Meta bool
+
+	// N is the index of the chunk, counting from zero for each kind.
+	N uint64
+
+	Err error
+}
+
+func (e *ChunkError) Error() string {
+	kind := "data"
+	if e.Meta {
+		kind = "metadata"
+	}
+	return fmt.Sprintf("%s (%s chunk %d)", e.Err, kind, e.N)
+}
+
+// Verification is what VerifyData found.
+type Verification struct {
+	// DataChunks and MetaChunks are how many chunks of each kind were found.
+	DataChunks, MetaChunks int
+
+	// Length is how much data the chunks that could be decrypted hold.
+	Length int64
+
+	// Metadata is the entry's metadata, or nil if it couldn't be read.
+	Metadata *Metadata
+
+	// Problems lists everything found wrong with the entry, in the order it was found.
+	// Problems with a particular chunk are a *ChunkError.
+	Problems []error
+}
+
+// VerifyData decrypts every chunk of an entry without writing the plaintext anywhere,
+// checking the padding of each and then the length and hash of the whole. Unlike
+// ExportData it carries on past damaged chunks, so that every one of them is reported.
+// An error is only returned if the entry doesn't exist or can't be read at all.
+func VerifyData(db coffer.Store, format *Format, rootIdentifier, masterKey *memguard.LockedBuffer) (*Verification, error) {
+	// Check if this entry exists.
+	exists, err := Exists(db, rootIdentifier)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrEntryNotFound
+	}
+
+	// Without readable metadata, go by the first data chunk instead.
+	version, err := EntryVersion(db, format, rootIdentifier, masterKey)
+	if err == ErrMetadataMissing || err == crypto.ErrDecryptionFailed {
+		version, err = dataVersion(db, format, rootIdentifier, masterKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	v := new(Verification)
+	if err := v.metadata(db, format, version, rootIdentifier, masterKey); err != nil {
+		return nil, err
+	}
+	if err := v.data(db, format, version, rootIdentifier, masterKey); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// metadata decrypts and parses every metadata chunk.
+func (v *Verification) metadata(db coffer.Store, format *Format, version int, rootIdentifier, masterKey *memguard.LockedBuffer) error {
+	var data []byte
+	defer func() { memguard.WipeBytes(data) }()
+
+	damaged, ended := false, false
+	for n := uint64(0); ; n++ {
+		ct, err := db.Retrieve(crypto.DeriveMetaIdentifierN(rootIdentifier, -int(n)-1))
+		if err != nil {
+			return err
+		}
+		if ct == nil {
+			break
+		}
+		v.MetaChunks++
+
+		// Nothing may follow the final chunk.
+		if ended {
+			v.Problems = append(v.Problems, &ChunkError{true, n, ErrEntryTruncated})
+			continue
+		}
+		pt, final, err := openChunk(format, ct, version, crypto.DomainMeta, n, rootIdentifier, masterKey)
+		if err != nil {
+			v.Problems = append(v.Problems, &ChunkError{true, n, err})
+			damaged = true
+			continue
+		}
+		data = append(data, pt...)
+		memguard.WipeBytes(pt)
+		ended = final
+	}
+
+	switch {
+	case v.MetaChunks == 0:
+		v.Problems = append(v.Problems, ErrMetadataMissing)
+	case damaged:
+	case version != Version1 && !ended:
+		// Only old entries may end without a final chunk.
+		v.Problems = append(v.Problems, &ChunkError{true, uint64(v.MetaChunks), ErrEntryTruncated})
+	default:
+		metaObj, err := gabs.ParseJSON(data)
+		if err != nil {
+			v.Problems = append(v.Problems, ErrMetadataInvalid)
+		} else if v.Metadata, err = parseMetadata(metaObj); err != nil {
+			v.Problems = append(v.Problems, err)
+		}
+	}
+
+	return nil
+}
+
+// data decrypts every data chunk, several at a time, and checks them against the
+// metadata.
+func (v *Verification) data(db coffer.Store, format *Format, version int, rootIdentifier, masterKey *memguard.LockedBuffer) error {
+	damaged, ended := false, false
+	hash, _ := blake2b.New256(nil)
+	produce := func(n uint64) (*chunk, error) {
+		ct, err := db.Retrieve(crypto.DeriveIdentifierN(rootIdentifier, n))
+		if err != nil || ct == nil {
+			return nil, err
+		}
+		return &chunk{data: ct}, nil
+	}
+	process := func(c *chunk) {
+		c.data, c.final, c.err = openChunk(format, c.data, version, crypto.DomainData, c.n, rootIdentifier, masterKey)
+	}
+	consume := func(c *chunk) error {
+		defer memguard.WipeBytes(c.data)
+
+		v.DataChunks++
+		switch {
+		case ended:
+			v.Problems = append(v.Problems, &ChunkError{false, c.n, ErrEntryTruncated})
+		case c.err != nil:
+			v.Problems = append(v.Problems, &ChunkError{false, c.n, c.err})
+			damaged = true
+		default:
+			ended = c.final
+			v.Length += int64(len(c.data))
+			hash.Write(c.data)
+		}
+		return nil
+	}
+	discard := func(c *chunk) {
+		memguard.WipeBytes(c.data)
+	}
+	if err := runPipeline(format.buffers(), produce, process, consume, discard); err != nil {
+		return err
+	}
+
+	// The length and hash mean nothing once a chunk is known to be missing.
+	if damaged {
+		return nil
+	}
+	if version != Version1 && !ended {
+		v.Problems = append(v.Problems, &ChunkError{false, uint64(v.DataChunks), ErrEntryTruncated})
+		return nil
+	}
+	if v.Metadata == nil {
+		return nil
+	}
+	if v.Length != v.Metadata.Length {
+		v.Problems = append(v.Problems, ErrDataIncomplete)
+	} else if v.Metadata.Hash != nil && !bytes.Equal(hash.Sum(nil), v.Metadata.Hash) {
+		v.Problems = append(v.Problems, ErrHashMismatch)
+	}
+
+	return nil
+}
+
+// dataVersion works out which protocol version an entry is stored under by trying to
+// decrypt its first data chunk, for when its metadata can't be read. If that can't be
+// decrypted either, the entry is taken to be current.
+func dataVersion(db coffer.Store, format *Format, rootIdentifier, masterKey *memguard.LockedBuffer) (int, error) {
+	ct, err := db.Retrieve(crypto.DeriveIdentifierN(rootIdentifier, 0))
+	if err != nil {
+		return 0, err
+	}
+
+	for _, version := range []int{Version2, Version1} {
+		pt, _, err := openChunk(format, ct, version, crypto.DomainData, 0, rootIdentifier, masterKey)
+		if err == nil {
+			memguard.WipeBytes(pt)
+			return version, nil
+		}
+	}
+
+	return Version2, nil
+}
@@ -0,0 +1,85 @@
+package data
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/awnumar/dissident/coffer"
+	"github.com/awnumar/dissident/crypto"
+)
+
+func TestVerifyData(t *testing.T) {
+	// Spans three chunks.
+	plaintext, _ := crypto.GenerateRandomBytes(10000)
+
+	db := coffer.NewMemory()
+	rootIdentifier, masterKey := testKeys(t)
+	if _, err := VerifyData(db, nil, rootIdentifier, masterKey); err != ErrEntryNotFound {
+		t.Error("Expected ErrEntryNotFound; got", err)
+	}
+	if err := ImportData(db, nil, bytes.NewReader(plaintext), nil, rootIdentifier, masterKey); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	// verify checks that exactly the given problems are found.
+	verify := func(want ...error) *Verification {
+		t.Helper()
+		v, err := VerifyData(db, nil, rootIdentifier, masterKey)
+		if err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		if len(v.Problems) != len(want) {
+			t.Fatal("Expected", want, "; got", v.Problems)
+		}
+		for i, problem := range v.Problems {
+			if problem.Error() != want[i].Error() {
+				t.Error("Expected", want[i], "; got", problem)
+			}
+		}
+		return v
+	}
+
+	v := verify()
+	if v.DataChunks != 3 || v.MetaChunks != 1 || v.Length != int64(len(plaintext)) || v.Metadata == nil {
+		t.Errorf("Unexpected verification: %+v", v)
+	}
+
+	// A damaged chunk is pointed out, and the rest are still checked.
+	id := crypto.DeriveIdentifierN(rootIdentifier, 1)
+	ct, _ := db.Retrieve(id)
+	db.Save(id, bytes.Repeat([]byte{0}, len(ct)))
+	v = verify(&ChunkError{false, 1, crypto.ErrDecryptionFailed})
+	if msg := v.Problems[0].Error(); msg != "! Decryption failed; data is likely corrupted (data chunk 1)" {
+		t.Error("Unexpected message:", msg)
+	}
+	if v.DataChunks != 3 {
+		t.Error("Expected every chunk to be checked; got", v.DataChunks)
+	}
+	db.Save(id, ct)
+
+	// So are chunks added after the final one, or a final one taken away.
+	last := crypto.DeriveIdentifierN(rootIdentifier, 2)
+	final, _ := db.Retrieve(last)
+	db.Save(crypto.DeriveIdentifierN(rootIdentifier, 3), ct)
+	verify(&ChunkError{false, 3, ErrEntryTruncated})
+	db.Delete(crypto.DeriveIdentifierN(rootIdentifier, 3))
+	db.Delete(last)
+	verify(&ChunkError{false, 2, ErrEntryTruncated})
+	db.Save(last, final)
+
+	// Chunks that decrypt but are padded wrongly.
+	key, _ := crypto.DeriveChunkKey(masterKey, rootIdentifier, crypto.DomainData, 0, false)
+	bad, _ := crypto.DefaultSuite.Encrypt(bytes.Repeat([]byte{7}, DefaultChunkSize), key)
+	first, _ := db.Retrieve(crypto.DeriveIdentifierN(rootIdentifier, 0))
+	db.Save(crypto.DeriveIdentifierN(rootIdentifier, 0), bad)
+	verify(&ChunkError{false, 0, crypto.ErrInvalidPadding})
+	db.Save(crypto.DeriveIdentifierN(rootIdentifier, 0), first)
+
+	// Without the metadata the data chunks can still be checked, but not the length.
+	meta := crypto.DeriveMetaIdentifierN(rootIdentifier, -1)
+	db.Save(meta, bytes.Repeat([]byte{0}, len(ct)))
+	v = verify(&ChunkError{true, 0, crypto.ErrDecryptionFailed})
+	if v.Metadata != nil || v.Length != int64(len(plaintext)) {
+		t.Errorf("Unexpected verification: %+v", v)
+	}
+}
@@ -1,206 +1,712 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"math"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/awnumar/dissident/coffer"
 	"github.com/awnumar/dissident/crypto"
 	"github.com/awnumar/dissident/data"
 	"github.com/awnumar/dissident/stdin"
+	"github.com/awnumar/dissident/vault"
 	"github.com/awnumar/memguard"
 	"github.com/cheggaaa/pb"
 )
 
 var (
-	// The default cost factor for key deriviation.
-	scryptCost = map[string]int{"N": 18, "r": 16, "p": 1}
-
 	// Store a global reference to the master password.
 	masterPassword *memguard.LockedBuffer
+
+	// Store a global reference to the digest of the keyfiles, if any were given.
+	keyfiles *memguard.LockedBuffer
+
+	// Store a global reference to the open vault.
+	store *vault.Vault
+
+	// Held while the open vault is replaced or closed, so that an interrupt can close it.
+	storeLock sync.Mutex
+
+	// Store a global reference to the path of the open vault.
+	storePath string
+
+	// Store a global reference to the session for the master password in that vault.
+	session *vault.Session
+
+	// Options for opening and creating vaults.
+	options = new(vault.Options)
+
+	// The size of new vaults, which are kept in a single container file if it isn't zero.
+	containerSize int64
 )
 
+// errStdio is returned when the interactive session is asked to use standard input or output.
+var errStdio = errors.New("! Use the import and export subcommands to read from standard input or write to standard output")
+
 func main() {
-	// Setup the secret store.
-	err := coffer.Setup()
-	if err != nil {
-		fmt.Println(err)
-		return
+	os.Exit(run())
+}
+
+func run() int {
+	vaultPath := flag.String("vault", os.Getenv("DISSIDENT_VAULT"), "path to the coffer (default ~/.dissident/coffer)")
+	create := flag.Bool("create", false, "create the vault without asking if it does not exist")
+	kdf := flag.String("kdf", os.Getenv("DISSIDENT_KDF"), "KDF for new vaults, e.g. argon2id:t=3,m=262144,p=4 (default "+crypto.DefaultKDF.String()+")")
+	cipher := flag.String("cipher", os.Getenv("DISSIDENT_CIPHER"), "cipher suite for new vaults: xsalsa20poly1305, xchacha20poly1305 or aes256gcmsiv (default "+crypto.DefaultSuite.String()+")")
+	var keyfilePaths pathList
+	flag.Var(&keyfilePaths, "keyfile", "mix the contents of this file into the master password; may be repeated")
+	flag.BoolVar(&options.Hierarchy, "hierarchy", false, "for new vaults, stretch the master password once per session instead of once per entry")
+	flag.BoolVar(&options.ConstantSize, "constant-size", false, "for new vaults, swap decoys for chunks so that the number of values never changes")
+	chunkSize := flag.Int("chunk-size", 0, "chunk size in KiB for new vaults, e.g. 4, 64 or 1024 (default 4)")
+	container := flag.String("container", "", "create new vaults as a single file of this size filled with random bytes, e.g. 512M or 4G")
+	flag.IntVar(&options.Buffers, "buffers", 0, "how many chunks to encrypt or decrypt at once, bounding the plaintext held in memory (default 2 per CPU)")
+	flag.Usage = usage
+	flag.Parse()
+
+	// Parse the KDF specification, if there is one.
+	if *kdf != "" {
+		var err error
+		if options.KDF, err = crypto.ParseKDF(*kdf); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitUsage
+		}
 	}
-	defer coffer.Close()
 
-	// Cleanup memory when exiting.
-	memguard.CatchInterrupt(func() {})
+	// Parse the cipher suite, if there is one.
+	if *cipher != "" {
+		var err error
+		if options.Suite, err = crypto.ParseSuite(*cipher); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitUsage
+		}
+	}
+
+	// Check the chunk size, if there is one.
+	if *chunkSize != 0 {
+		options.ChunkSize = *chunkSize << 10
+		if *chunkSize < 0 || *chunkSize > data.MaxChunkSize>>10 || data.CheckChunkSize(options.ChunkSize) != nil {
+			fmt.Fprintln(os.Stderr, data.ErrInvalidChunkSize)
+			return exitUsage
+		}
+	}
+
+	// Parse the container size, if there is one.
+	if *container != "" {
+		var err error
+		if containerSize, err = parseSize(*container); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitUsage
+		}
+	}
+
+	// Hash the keyfiles up front, so that a missing one is noticed straight away.
+	if len(keyfilePaths) != 0 {
+		var err error
+		if keyfiles, err = hashKeyfiles(keyfilePaths); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitFailure
+		}
+	}
+
+	// Fall back to the default location.
+	if *vaultPath == "" {
+		path, err := coffer.DefaultPath()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitFailure
+		}
+		*vaultPath = path
+	}
+
+	// Without a subcommand we run interactively.
+	interactive := flag.NArg() == 0
+	if !interactive {
+		if _, ok := commands[flag.Arg(0)]; !ok {
+			fmt.Fprintf(os.Stderr, "! Unknown command: %s\n\n", flag.Arg(0))
+			usage()
+			return exitUsage
+		}
+	}
+
+	// Inspecting the vault leaves it as it was.
+	options.ReadOnly = !interactive && readOnly[flag.Arg(0)]
+
+	// Decide what to do if there is no vault yet.
+	confirm := func(path string) bool { return *create }
+	if interactive && !*create {
+		confirm = confirmCreate
+	}
+
+	// Setup the secret store.
+	if err := openVault(*vaultPath, confirm); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	defer closeStore()
+
+	// Cleanup memory when exiting. Closing the vault discards any half-finished
+	// transaction, leaving it exactly as it was before the operation started. The lock
+	// is never released, since the program exits with it held.
+	memguard.CatchInterrupt(func() {
+		storeLock.Lock()
+		if store != nil {
+			store.Close()
+		}
+		memguard.SafeExit(exitInterrupted)
+	})
 	defer memguard.DestroyAll()
 
+	if !interactive {
+		return runCommand(flag.Args())
+	}
+
 	// Launch CLI.
-	err = cli()
-	if err != nil {
+	fmt.Printf("+ Opened vault at %s\n", *vaultPath)
+	if err := cli(); err != nil {
 		fmt.Println(err)
+		return exitFailure
+	}
+
+	return exitOK
+}
+
+// pathList collects the values of a flag that may be given more than once.
+type pathList []string
+
+func (p *pathList) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *pathList) Set(path string) error {
+	*p = append(*p, path)
+	return nil
+}
+
+// hashKeyfiles reads the keyfiles at paths and combines them into a single digest.
+func hashKeyfiles(paths []string) (*memguard.LockedBuffer, error) {
+	readers := make([]io.Reader, len(paths))
+	for i, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		readers[i] = f
 	}
+
+	return crypto.HashKeyfiles(readers...)
+}
+
+// withKeyfiles mixes the keyfiles, if any were given, into password. The password
+// that is passed in must not be used afterwards.
+func withKeyfiles(password *memguard.LockedBuffer) (*memguard.LockedBuffer, error) {
+	if keyfiles == nil {
+		return password, nil
+	}
+	defer password.Destroy()
+
+	return crypto.AddKeyfiles(password, keyfiles)
+}
+
+// openVault opens the coffer at path, replacing any coffer that is currently open. If
+// nothing exists at path, a new coffer is only created there if confirm returns true.
+func openVault(path string, confirm func(path string) bool) error {
+	// An interrupted shred-vault may have left the database under another name.
+	if !options.ReadOnly && !coffer.IsContainer(path) {
+		if err := coffer.FinishRewrite(path); err != nil {
+			return err
+		}
+	}
+
+	create := false
+	if _, err := os.Stat(path); err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+
+		// Only create a new coffer if the user explicitly asks for one.
+		if options.ReadOnly || !confirm(path) {
+			return fmt.Errorf("! No vault found at %s", path)
+		}
+		create = true
+	}
+
+	var backend coffer.Backend
+	var err error
+	switch {
+	case create && containerSize != 0:
+		backend, err = coffer.CreateContainer(path, containerSize, options.ValueSize())
+	case options.ReadOnly && coffer.IsContainer(path):
+		backend, err = coffer.OpenContainerReadOnly(path)
+	case options.ReadOnly:
+		backend, err = coffer.OpenLevelDBReadOnly(path)
+	case !create && coffer.IsContainer(path):
+		backend, err = coffer.OpenContainer(path)
+	default:
+		backend, err = coffer.OpenLevelDB(path, create)
+	}
+	if err != nil {
+		return err
+	}
+	// New vaults get their own random salt.
+	open := vault.Open
+	if create {
+		open = vault.Create
+	}
+	v, err := open(backend, options)
+	if err != nil {
+		backend.Close()
+		return err
+	}
+
+	// Swap out the old vault.
+	setStore(v)
+	storePath = path
+
+	return nil
+}
+
+// setStore closes the open vault, if there is one, and replaces it with v.
+func setStore(v *vault.Vault) {
+	storeLock.Lock()
+	defer storeLock.Unlock()
+
+	if store != nil {
+		store.Close()
+	}
+	store = v
+}
+
+// closeStore closes the open vault, if there is one.
+func closeStore() {
+	setStore(nil)
+}
+
+// parseSize parses a size in bytes, optionally followed by K, M, G or T for KiB, MiB,
+// GiB or TiB.
+func parseSize(size string) (int64, error) {
+	shift := uint(0)
+	if n := len(size); n != 0 {
+		if i := strings.IndexByte("KMGT", size[n-1]); i != -1 {
+			shift = 10 * uint(i+1)
+			size = size[:n-1]
+		}
+	}
+
+	n, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || n <= 0 || n > math.MaxInt64>>shift {
+		return 0, errors.New("! Invalid size; expected something like 512M or 4G")
+	}
+	return n << shift, nil
+}
+
+// confirmCreate asks the user whether a new vault should be created at path.
+func confirmCreate(path string) bool {
+	answer := stdin.Standard(fmt.Sprintf("! No vault found at %s; create one? [y/N] ", path))
+	return strings.ToLower(strings.TrimSpace(answer)) == "y"
 }
 
 func cli() error {
-	help := `import [path] - Import a new file to the database.
-export [path] - Retrieve data from the database and export to a file.
+	help := `open [path]   - Close the current vault and open the one at path.
+import [path] - Import a new file or directory to the database.
+export [path] - Retrieve data from the database and export to a file or directory.
 peak          - Grab data from the database and print it to the screen.
+verify        - Check that every chunk of an entry decrypts, without writing anything.
 remove        - Remove some previously stored data from the database.
+migrate       - Re-encrypt an entry stored by an older version or under a previous salt or KDF.
 decoys        - Add a variable amount of random decoy data.
 exit          - Exit the program.`
 
-	masterPassword = stdin.GetMasterPassword()
+	var err error
+	if masterPassword, err = withKeyfiles(stdin.GetMasterPassword()); err != nil {
+		return err
+	}
 	fmt.Println("") // For formatting.
+	if err := startSession(); err != nil {
+		return err
+	}
 
 	for {
 		cmd := strings.Split(strings.TrimSpace(stdin.Standard("$ ")), " ")
 
+		var err error
 		switch cmd[0] {
+		case "open":
+			if len(cmd) < 2 {
+				err = errors.New("! Missing argument: path")
+			} else if err = openVault(cmd[1], confirmCreate); err == nil {
+				fmt.Printf("+ Opened vault at %s\n", cmd[1])
+				err = startSession()
+			}
 		case "import":
 			if len(cmd) < 2 {
-				fmt.Println("! Missing argument: path")
+				err = errors.New("! Missing argument: path")
 			} else {
-				importFromDisk(cmd[1])
+				err = importFromDisk(cmd[1])
 			}
 		case "export":
 			if len(cmd) < 2 {
-				fmt.Println("! Missing argument: path")
+				err = errors.New("! Missing argument: path")
 			} else {
-				exportToDisk(cmd[1])
+				err = exportToDisk(cmd[1])
 			}
 		case "peak":
-			peak()
+			err = peak()
+		case "verify":
+			err = verify()
 		case "remove":
-			remove()
+			err = remove()
+		case "migrate":
+			err = migrate()
 		case "decoys":
-			decoys()
+			err = decoys()
 		case "exit":
 			return nil
 		default:
 			fmt.Println(help)
 		}
+
+		// Report anything that went wrong.
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+// startSession starts a session for the master password in the open vault, replacing
+// the previous one. In vaults using the key hierarchy this is when the root key is
+// generated.
+func startSession() error {
+	if store.Hierarchy() {
+		fmt.Println("+ Generating root key...")
+	}
+	s, err := store.Session(masterPassword)
+	if err != nil {
+		return err
 	}
+
+	if session != nil {
+		session.Destroy()
+	}
+	session = s
+
+	return nil
 }
 
-func importFromDisk(path string) {
+// promptEntry asks for an identifier and derives the keys for its entry.
+func promptEntry() (*vault.Entry, error) {
+	// Prompt the user for the identifier.
+	identifier := stdin.Secure("- Secure identifier: ")
+	defer identifier.Destroy()
+
+	// Derive the secure values for this "branch".
+	if !store.Hierarchy() {
+		fmt.Println("+ Generating root key...")
+	}
+	return session.Entry(identifier)
+}
+
+func importFromDisk(path string) error {
+	// Standard input is where our commands come from.
+	if path == "-" {
+		return errStdio
+	}
+
 	// Handle the file.
 	info, err := os.Stat(path)
 	if err != nil {
 		if os.IsNotExist(err) {
-			fmt.Printf("! %s does not exist\n", path)
-		} else {
-			fmt.Println(err)
+			return fmt.Errorf("! %s does not exist", path)
 		}
-		return
+		return err
 	}
 
 	if info.IsDir() {
-		fmt.Println("! We can't handle directories yet")
-		return
+		return importDirectory(path)
 	}
 
-	// Prompt the user for the identifier.
-	identifier := stdin.Secure("- Secure identifier: ")
-	defer identifier.Destroy()
+	// Open the file.
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsPermission(err) {
+			return fmt.Errorf("! Insufficient permissions to open %s", path)
+		}
+		return err
+	}
+	defer f.Close()
 
-	// Derive the secure values for this "branch".
-	fmt.Println("+ Generating root key...")
-	masterKey, rootIdentifier := crypto.DeriveSecureValues(masterPassword, identifier, scryptCost)
-	defer masterKey.Destroy()
-	defer rootIdentifier.Destroy()
+	entry, err := promptEntry()
+	if err != nil {
+		return err
+	}
+	defer entry.Destroy()
 
 	// Check if it exists already.
-	derivedIdentifierN := crypto.DeriveIdentifierN(rootIdentifier, 0)
-	if coffer.Exists(derivedIdentifierN) {
-		fmt.Println("! Cannot overwrite existing entry")
-		return
+	exists, err := entry.Exists()
+	if err != nil {
+		return err
+	}
+	if exists {
+		return data.ErrEntryExists
 	}
 
-	// Add the metadata to coffer.
-	fmt.Println("+ Adding metadata...")
-	data.MetaSetLength(info.Size(), rootIdentifier, masterKey)
+	// Start the progress bar.
+	bar := pb.New64(info.Size()).Prefix("+ Importing ")
+	bar.ShowSpeed = true
+	bar.SetUnits(pb.U_BYTES)
+	bar.Start()
 
-	// Import this entry from disk.
-	data.ImportData(path, info.Size(), rootIdentifier, masterKey)
+	// Import this entry and its metadata from disk.
+	err = entry.PutFile(context.Background(), bar.NewProxyReader(f), info)
+	bar.Finish()
+	if err != nil {
+		return err
+	}
 
 	// Output status message.
 	fmt.Println("+ Imported successfully.")
+	return nil
 }
 
-func exportToDisk(path string) {
-	// Prompt the user for the identifier.
-	identifier := stdin.Secure("- Secure identifier: ")
-	defer identifier.Destroy()
+// importDirectory imports a whole directory tree as a single entry.
+func importDirectory(path string) error {
+	entry, err := promptEntry()
+	if err != nil {
+		return err
+	}
+	defer entry.Destroy()
 
-	// Derive the secure values for this "branch".
-	fmt.Println("+ Generating root key...")
-	masterKey, rootIdentifier := crypto.DeriveSecureValues(masterPassword, identifier, scryptCost)
-	defer masterKey.Destroy()
-	defer rootIdentifier.Destroy()
+	// Check if it exists already.
+	exists, err := entry.Exists()
+	if err != nil {
+		return err
+	}
+	if exists {
+		return data.ErrEntryExists
+	}
 
-	// Check if this entry exists.
-	derivedIdentifierN := crypto.DeriveIdentifierN(rootIdentifier, 0)
-	if !coffer.Exists(derivedIdentifierN) {
-		fmt.Println("! This entry does not exist")
-		return
+	// Archive and import the tree.
+	fmt.Println("+ Importing directory...")
+	if err := entry.PutDirectory(context.Background(), path); err != nil {
+		return err
+	}
+
+	// Output status message.
+	fmt.Println("+ Imported successfully.")
+	return nil
+}
+
+func exportToDisk(path string) error {
+	// Use peak to print to the screen instead.
+	if path == "-" {
+		return errStdio
+	}
+
+	entry, err := promptEntry()
+	if err != nil {
+		return err
+	}
+	defer entry.Destroy()
+
+	// Get the metadata. This fails if the entry does not exist.
+	meta, err := entry.Metadata()
+	if err != nil {
+		return err
 	}
 
+	// Directories are rebuilt in place.
+	path = exportTarget(path, meta)
+	if meta.Directory {
+		fmt.Println("+ Extracting directory...")
+		if err := entry.GetDirectory(context.Background(), path); err != nil {
+			if os.IsExist(err) {
+				return fmt.Errorf("! %s already exists; cannot overwrite", path)
+			}
+			return err
+		}
+
+		fmt.Printf("+ Saved to %s\n", path)
+		return nil
+	}
+
+	// Atempt to open the file now.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("! %s already exists; cannot overwrite", path)
+		} else if os.IsPermission(err) {
+			return fmt.Errorf("! Insufficient permissions to open %s", path)
+		}
+		return err
+	}
+	defer f.Close()
+
+	// Start the progress bar object.
+	bar := pb.New64(meta.Length).Prefix("+ Exporting ")
+	bar.ShowSpeed = true
+	bar.SetUnits(pb.U_BYTES)
+	bar.Start()
+
 	// Export the entry.
-	data.ExportData(path, rootIdentifier, masterKey)
+	err = entry.Get(context.Background(), io.MultiWriter(f, bar))
+	bar.Finish()
+	if err != nil {
+		return err
+	}
+
+	// Put back the original permissions and modification time.
+	if err := vault.Restore(path, meta); err != nil {
+		return err
+	}
+
+	fmt.Printf("+ Saved to %s\n", path)
+	return nil
 }
 
-func peak() {
-	// Prompt the user for the identifier.
-	identifier := stdin.Secure("- Secure identifier: ")
+// exportTarget returns where an entry should be exported to. If path is an existing
+// directory, the entry is saved inside it under its original name.
+func exportTarget(path string, meta *data.Metadata) string {
+	name := filepath.Base(meta.Name)
+	if meta.Name == "" || name == "." || name == ".." || name == string(filepath.Separator) {
+		return path
+	}
 
-	// Derive the secure values for this "branch".
-	fmt.Println("+ Generating root key...")
-	masterKey, rootIdentifier := crypto.DeriveSecureValues(masterPassword, identifier, scryptCost)
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return filepath.Join(path, name)
+	}
+	return path
+}
+
+func peak() error {
+	entry, err := promptEntry()
+	if err != nil {
+		return err
+	}
+	defer entry.Destroy()
 
 	// Check if this entry exists.
-	derivedIdentifierN := crypto.DeriveIdentifierN(rootIdentifier, 0)
-	if !coffer.Exists(derivedIdentifierN) {
-		fmt.Println("! This entry does not exist")
-		return
+	exists, err := entry.Exists()
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return data.ErrEntryNotFound
 	}
 
 	// It exists, proceed to get data.
-	data.ViewData(rootIdentifier, masterKey)
+	fmt.Println("\n-----BEGIN PLAINTEXT-----")
+	err = entry.Get(context.Background(), os.Stdout)
+	fmt.Println("-----END PLAINTEXT-----")
+
+	return err
 }
 
-func remove() {
-	// Prompt the user for the identifier.
-	identifier := stdin.Secure("- Secure identifier: ")
+func verify() error {
+	entry, err := promptEntry()
+	if err != nil {
+		return err
+	}
+	defer entry.Destroy()
 
-	// Derive the secure values for this "branch".
-	fmt.Println("+ Generating root key...")
-	masterKey, rootIdentifier := crypto.DeriveSecureValues(masterPassword, identifier, scryptCost)
+	return verifyEntry(entry)
+}
+
+// verifyEntry decrypts every chunk of an entry and reports what is wrong with it.
+func verifyEntry(entry *vault.Entry) error {
+	v, err := entry.Verify()
+	if err != nil {
+		return err
+	}
+
+	for _, problem := range v.Problems {
+		fmt.Println(problem)
+	}
+	if len(v.Problems) != 0 {
+		return fmt.Errorf("! Found %d problems in %d data and %d metadata chunks", len(v.Problems), v.DataChunks, v.MetaChunks)
+	}
+	fmt.Printf("+ Verified %d data and %d metadata chunks holding %d bytes.\n", v.DataChunks, v.MetaChunks, v.Length)
+	return nil
+}
+
+func remove() error {
+	entry, err := promptEntry()
+	if err != nil {
+		return err
+	}
+	defer entry.Destroy()
 
 	// Check if this entry exists.
-	derivedIdentifierN := crypto.DeriveIdentifierN(rootIdentifier, 0)
-	if !coffer.Exists(derivedIdentifierN) {
-		fmt.Println("! There is nothing here to remove")
-		return
+	exists, err := entry.Exists()
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.New("! There is nothing here to remove")
 	}
 
 	// Remove the data.
-	data.RemoveData(rootIdentifier, masterKey)
+	fmt.Println("+ Removing...")
+	if err := entry.Delete(); err != nil {
+		return err
+	}
+
+	fmt.Println("+ Successfully removed data.")
+	return nil
+}
+
+func migrate() error {
+	entry, err := promptEntry()
+	if err != nil {
+		return err
+	}
+	defer entry.Destroy()
+
+	// Nothing to do if it is already current.
+	migrate, err := entry.NeedsMigration()
+	if err != nil {
+		return err
+	}
+	if !migrate {
+		fmt.Println("+ This entry is already up to date.")
+		return nil
+	}
+
+	fmt.Println("+ Migrating...")
+	if err := entry.Migrate(); err != nil {
+		return err
+	}
+
+	fmt.Println("+ Successfully migrated data.")
+	return nil
 }
 
-func decoys() {
+func decoys() error {
 	var numberOfDecoys int
 	var err error
 
 	// Print some help information.
-	fmt.Println(`
+	fmt.Print(`
 :: For deniable encryption, use this feature in conjunction with some fake data manually-added
    under a different master-password. Then if you are ever forced to hand over your keys,
    simply give up the fake data and claim that the rest of the entries in the database are decoys.
 
 :: You do not necessarily have to make use of this feature. Rather, simply the fact that
    it exists allows you to claim that some or all of the entries in the database are decoys.
+
+`)
+	if store.ConstantSize() {
+		fmt.Print(`:: This vault keeps a constant size. The decoys are marked as belonging to this master password,
+   and entries stored under it replace them to make room.
+
 `)
+	}
 
 	// Get the number of decoys to add as an int.
 	for {
@@ -211,21 +717,12 @@ func decoys() {
 		fmt.Println("! Input must be an integer")
 	}
 
-	// Create and configure the progress bar object.
-	bar := pb.New64(int64(numberOfDecoys)).Prefix("+ Adding ")
-	bar.ShowSpeed = true
-	bar.SetUnits(pb.U_NO)
-	bar.Start()
-
-	for i := 0; i < numberOfDecoys; i++ {
-		// Generate the decoy.
-		identifier, ciphertext := crypto.GenDecoy()
-
-		// Save to the database.
-		coffer.Save(identifier, ciphertext)
-
-		// Increment progress bar.
-		bar.Increment()
+	// Generate and save them all at once.
+	fmt.Printf("+ Adding %d decoys...\n", numberOfDecoys)
+	if err := session.AddDecoys(numberOfDecoys); err != nil {
+		return err
 	}
-	bar.FinishPrint(fmt.Sprintf("+ Added %d decoys.", numberOfDecoys))
+
+	fmt.Printf("+ Added %d decoys.\n", numberOfDecoys)
+	return nil
 }
@@ -0,0 +1,120 @@
+package stdin
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sync"
+
+	"github.com/awnumar/memguard"
+)
+
+// maxSecretLength is the longest secret that can be read from a non-interactive source.
+const maxSecretLength = 4096
+
+// ReadSecret reads a single line from r and returns it, without the line ending, in a
+// LockedBuffer. It reads one byte at a time so that nothing after the line is consumed,
+// which lets several secrets be read one after the other from the same descriptor.
+func ReadSecret(r io.Reader) (*memguard.LockedBuffer, error) {
+	buf, err := memguard.New(maxSecretLength, false)
+	if err != nil {
+		return nil, err
+	}
+	defer buf.Destroy()
+
+	var length int
+	for {
+		if length == maxSecretLength {
+			return nil, errors.New("! Secret is too long")
+		}
+
+		n, err := r.Read(buf.Buffer[length : length+1])
+		if n == 1 {
+			if buf.Buffer[length] == '\n' {
+				break
+			}
+			length++
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Strip a carriage return left over from a CRLF line ending.
+	if length > 0 && buf.Buffer[length-1] == '\r' {
+		length--
+	}
+
+	if length == 0 {
+		return nil, errors.New("! Secret is empty")
+	}
+
+	return memguard.Trim(buf, 0, length)
+}
+
+// descriptors holds a file for each descriptor FromFD has read from. Without a reference
+// the garbage collector would close the descriptor, and the next secret read from it
+// would fail.
+var descriptors = struct {
+	sync.Mutex
+	files map[int]*os.File
+}{files: make(map[int]*os.File)}
+
+// FromFD reads a secret from an open file descriptor. The descriptor is left open, so
+// that more secrets can be read from it.
+func FromFD(fd int) (*memguard.LockedBuffer, error) {
+	descriptors.Lock()
+	defer descriptors.Unlock()
+
+	f := descriptors.files[fd]
+	if f == nil {
+		if f = os.NewFile(uintptr(fd), "secret"); f == nil {
+			return nil, errors.New("! Invalid file descriptor")
+		}
+		descriptors.files[fd] = f
+	}
+
+	return ReadSecret(f)
+}
+
+// FromFile reads a secret from the first line of a file.
+func FromFile(path string) (*memguard.LockedBuffer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ReadSecret(f)
+}
+
+// Askpass runs an askpass program, passing it prompt as its only argument, and reads
+// the secret from the first line of its output.
+func Askpass(program, prompt string) (*memguard.LockedBuffer, error) {
+	cmd := exec.Command(program, prompt)
+	cmd.Stderr = os.Stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	secret, err := ReadSecret(stdout)
+
+	// Drain anything left over so that the program can exit.
+	io.Copy(ioutil.Discard, stdout)
+	if werr := cmd.Wait(); werr != nil && err == nil {
+		secret.Destroy()
+		return nil, werr
+	}
+
+	return secret, err
+}
@@ -0,0 +1,74 @@
+package stdin
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadSecret(t *testing.T) {
+	r := strings.NewReader("master password\r\nidentifier\n\nleftover")
+
+	// Two secrets from the same reader, one with a CRLF ending.
+	for _, expected := range []string{"master password", "identifier"} {
+		secret, err := ReadSecret(r)
+		if err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		if !bytes.Equal(secret.Buffer, []byte(expected)) {
+			t.Errorf("Expected %q; got %q", expected, secret.Buffer)
+		}
+		secret.Destroy()
+	}
+
+	// An empty line is not a secret.
+	if _, err := ReadSecret(r); err == nil {
+		t.Error("Expected an error reading an empty secret")
+	}
+
+	// Nothing past the line is consumed; the last line needs no ending.
+	secret, err := ReadSecret(r)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if !bytes.Equal(secret.Buffer, []byte("leftover")) {
+		t.Errorf("Expected %q; got %q", "leftover", secret.Buffer)
+	}
+	secret.Destroy()
+
+	// Overly long secrets are rejected.
+	if _, err := ReadSecret(strings.NewReader(strings.Repeat("a", maxSecretLength+1))); err == nil {
+		t.Error("Expected an error reading an overly long secret")
+	}
+}
+
+func TestFromFD(t *testing.T) {
+	f, err := ioutil.TempFile("", "dissident")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	f.WriteString("master password\nidentifier\n")
+	f.Seek(0, 0)
+
+	// Two secrets from the same descriptor, with a garbage collection in between that
+	// finalizes anything left unreferenced.
+	for _, expected := range []string{"master password", "identifier"} {
+		secret, err := FromFD(int(f.Fd()))
+		if err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		if !bytes.Equal(secret.Buffer, []byte(expected)) {
+			t.Errorf("Expected %q; got %q", expected, secret.Buffer)
+		}
+		secret.Destroy()
+
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+}
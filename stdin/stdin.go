@@ -3,6 +3,7 @@ package stdin
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"os"
 	"syscall"
@@ -20,7 +21,7 @@ func GetMasterPassword() *memguard.LockedBuffer {
 
 	// Check if password matches confirmation.
 	if !bytes.Equal(masterPassword.Buffer, confirmPassword.Buffer) {
-		fmt.Println("! Passwords do not match")
+		fmt.Fprintln(os.Stderr, "! Passwords do not match")
 		masterPassword.Destroy()
 		confirmPassword.Destroy()
 		return GetMasterPassword()
@@ -47,28 +48,69 @@ func Standard(prompt string) string {
 	return scanner.Text()
 }
 
-// Secure gets input without echoing and returns a byte slice.
+// Secure gets input without echoing and returns a byte slice. If standard input is
+// not a terminal the controlling terminal is used instead, and the prompt goes to
+// standard error, so that secrets can be entered while data is piped in or out.
 func Secure(prompt string) *memguard.LockedBuffer {
 	// Output prompt.
-	fmt.Print(prompt)
+	fmt.Fprint(os.Stderr, prompt)
+
+	// Find a terminal to read from.
+	fd, closeTerminal, err := openTerminal()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		memguard.SafeExit(1)
+	}
+	defer closeTerminal()
 
 	// Get input without echoing back.
-	rawinput, err := terminal.ReadPassword(int(syscall.Stdin))
+	rawinput, err := terminal.ReadPassword(fd)
 	if err != nil {
-		fmt.Println(err)
+		fmt.Fprintln(os.Stderr, err)
 		memguard.SafeExit(1)
 	}
 
 	// Secure the input value.
 	input, err := memguard.NewFromBytes(rawinput, false)
 	if err != nil {
-		fmt.Println("\n", err)
+		fmt.Fprintln(os.Stderr, "\n", err)
 		memguard.SafeExit(1)
 	}
 
 	// Output a newline for formatting.
-	fmt.Println()
+	fmt.Fprintln(os.Stderr)
 
 	// Return password.
 	return input
 }
+
+// HasTerminal reports whether there is a terminal to prompt the user on.
+func HasTerminal() bool {
+	_, closeTerminal, err := openTerminal()
+	if err != nil {
+		return false
+	}
+	closeTerminal()
+
+	return true
+}
+
+// openTerminal returns the descriptor of standard input if it is a terminal, or
+// otherwise of the controlling terminal of the process, along with a function that
+// releases it.
+func openTerminal() (int, func(), error) {
+	if terminal.IsTerminal(int(syscall.Stdin)) {
+		return int(syscall.Stdin), func() {}, nil
+	}
+
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return 0, nil, errors.New("! Not connected to a terminal")
+	}
+	if !terminal.IsTerminal(int(tty.Fd())) {
+		tty.Close()
+		return 0, nil, errors.New("! Not connected to a terminal")
+	}
+
+	return int(tty.Fd()), func() { tty.Close() }, nil
+}
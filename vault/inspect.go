@@ -0,0 +1,92 @@
+package vault
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/awnumar/dissident/coffer"
+)
+
+var (
+	// ErrForeignIdentifier is reported by Check for values stored under an identifier
+	// that isn't 32 bytes, which the vault never writes.
+	ErrForeignIdentifier = errors.New("! Identifier is not 32 bytes; not written by this vault")
+
+	// ErrTruncatedValue is reported by Check for values shorter than a chunk.
+	ErrTruncatedValue = errors.New("! Value is shorter than a chunk; it may be truncated")
+
+	// ErrMalformedValue is reported by Check for values longer than a chunk.
+	ErrMalformedValue = errors.New("! Value is longer than a chunk")
+)
+
+// Stats describes what is stored in a vault. Chunks and decoys look the same, so it says
+// nothing about which entries are real.
+type Stats struct {
+	// Values is how many values are stored, other than the vault's parameters.
+	Values int
+
+	// Bytes is their total size.
+	Bytes int64
+
+	// Sizes counts how many values there are of each size. Every chunk and decoy is
+	// ValueSize bytes, so in a healthy vault it has a single key.
+	Sizes map[int]int
+
+	// ValueSize is the size every value should be.
+	ValueSize int
+}
+
+// Problem is a value found by Check that this vault couldn't have written.
+type Problem struct {
+	Identifier []byte
+	Size       int
+	Err        error
+}
+
+func (p Problem) Error() string {
+	return fmt.Sprintf("%s (%x, %d bytes)", p.Err, p.Identifier, p.Size)
+}
+
+// Stats counts the values stored in the vault. It needs no password.
+func (v *Vault) Stats() (*Stats, error) {
+	stats := &Stats{Sizes: make(map[int]int), ValueSize: v.valueSize()}
+	err := v.backend.Walk(func(identifier, ciphertext []byte) error {
+		if bytes.Equal(identifier, coffer.ParamsKey) {
+			return nil
+		}
+		stats.Values++
+		stats.Bytes += int64(len(ciphertext))
+		stats.Sizes[len(ciphertext)]++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// Check looks through every value stored in the vault for any that couldn't be a chunk
+// or a decoy, and calls fn with each one. It needs no password, so it can't tell whether
+// a well-formed value has been tampered with.
+func (v *Vault) Check(fn func(Problem)) error {
+	size := v.valueSize()
+	return v.backend.Walk(func(identifier, ciphertext []byte) error {
+		switch {
+		case bytes.Equal(identifier, coffer.ParamsKey):
+		case len(identifier) != 32:
+			fn(Problem{identifier, len(ciphertext), ErrForeignIdentifier})
+		case len(ciphertext) < size:
+			fn(Problem{identifier, len(ciphertext), ErrTruncatedValue})
+		case len(ciphertext) > size:
+			fn(Problem{identifier, len(ciphertext), ErrMalformedValue})
+		}
+		return nil
+	})
+}
+
+// valueSize returns the size of every chunk and decoy in the vault.
+func (v *Vault) valueSize() int {
+	return v.format.ChunkSize + v.format.Suite.Overhead()
+}
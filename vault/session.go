@@ -0,0 +1,213 @@
+package vault
+
+import (
+	"github.com/awnumar/dissident/crypto"
+	"github.com/awnumar/dissident/data"
+	"github.com/awnumar/memguard"
+)
+
+// Session holds on to a master password so that several entries can be opened with it.
+// In vaults that use the key hierarchy the password is only stretched once, when the
+// session starts, and opening entries after that is cheap; otherwise each entry costs
+// as much as it does with Vault.Entry. A Session keeps the derivations the vault had
+// when it started, and is not safe for concurrent use.
+type Session struct {
+	vault       *Vault
+	derivations []derivation
+	password    *memguard.LockedBuffer
+
+	// Root secrets for the derivations that use the hierarchy, derived when needed.
+	roots []*memguard.LockedBuffer
+
+	// The key marking the decoys owned by the password, in constant-size vaults.
+	decoyKey *memguard.LockedBuffer
+}
+
+// Session starts a session for password. If the vault uses the key hierarchy, the
+// password is stretched into its root secret straight away.
+func (v *Vault) Session(password *memguard.LockedBuffer) (*Session, error) {
+	duplicate, err := memguard.Duplicate(password)
+	if err != nil {
+		return nil, err
+	}
+	s := &Session{
+		vault:       v,
+		derivations: v.derivations,
+		password:    duplicate,
+		roots:       make([]*memguard.LockedBuffer, len(v.derivations)),
+	}
+
+	if s.derivations[0].hierarchy {
+		if _, err := s.root(0); err != nil {
+			s.Destroy()
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// Entry derives the keys for the entry stored under identifier. The returned handle
+// remains valid after the session is destroyed.
+//
+// In vaults whose KDF or key hierarchy has changed, an entry that isn't found under the
+// current keys is looked for under each of the previous ones too. That costs another
+// expensive derivation for each, though only once per session where the hierarchy was
+// used.
+func (s *Session) Entry(identifier *memguard.LockedBuffer) (*Entry, error) {
+	e, err := s.entry(identifier)
+	if err != nil || !s.vault.ConstantSize() {
+		return e, err
+	}
+
+	// Let the entry make room for itself, and give back the room it takes up.
+	decoyKey, err := s.decoys()
+	if err == nil {
+		e.decoyKey, err = memguard.Duplicate(decoyKey)
+	}
+	if err != nil {
+		e.Destroy()
+		return nil, err
+	}
+	return e, nil
+}
+
+// AddDecoys adds n random decoys to the coffer. In constant-size vaults they are marked
+// as owned by the session's master password, so that entries stored under it can evict
+// them to make room.
+func (s *Session) AddDecoys(n int) error {
+	if !s.vault.ConstantSize() {
+		return s.vault.AddDecoys(n)
+	}
+
+	decoyKey, err := s.decoys()
+	if err != nil {
+		return err
+	}
+	return s.vault.reclaiming(decoyKey, func() error {
+		// They needn't be added all at once, so bound the memory each transaction takes.
+		for n > 0 {
+			batch := n
+			if batch > decoyBatch {
+				batch = decoyBatch
+			}
+			tx, err := s.vault.backend.Begin()
+			if err != nil {
+				return err
+			}
+			err = s.vault.addOwnedDecoys(tx, decoyKey, batch)
+			if err == nil {
+				err = tx.Commit()
+			}
+			tx.Discard()
+			if err != nil {
+				return err
+			}
+			n -= batch
+		}
+		return nil
+	})
+}
+
+// decoyBatch is how many decoys Session.AddDecoys adds in each transaction.
+const decoyBatch = 1024
+
+// entry is Entry, without the decoy key.
+func (s *Session) entry(identifier *memguard.LockedBuffer) (*Entry, error) {
+	masterKey, rootIdentifier, err := s.keys(0, identifier)
+	if err != nil {
+		return nil, err
+	}
+	e := &Entry{vault: s.vault, masterKey: masterKey, rootIdentifier: rootIdentifier}
+	if len(s.derivations) == 1 {
+		return e, nil
+	}
+
+	// Only fall back if there is nothing under the current keys.
+	if exists, err := e.Exists(); err != nil || exists {
+		return e, err
+	}
+	for i := 1; i < len(s.derivations); i++ {
+		oldMasterKey, oldRootIdentifier, err := s.keys(i, identifier)
+		if err != nil {
+			e.Destroy()
+			return nil, err
+		}
+		exists, err := data.Exists(s.vault.backend, oldRootIdentifier)
+		if err != nil || !exists {
+			oldMasterKey.Destroy()
+			oldRootIdentifier.Destroy()
+			if err != nil {
+				e.Destroy()
+				return nil, err
+			}
+			continue
+		}
+
+		// Use the old keys, keeping the current ones to migrate to.
+		return &Entry{
+			vault:          s.vault,
+			masterKey:      oldMasterKey,
+			rootIdentifier: oldRootIdentifier,
+			currentKey:     masterKey,
+			currentRoot:    rootIdentifier,
+		}, nil
+	}
+
+	return e, nil
+}
+
+// Destroy wipes the password and root secrets held by the session. It must not be used
+// afterwards.
+func (s *Session) Destroy() {
+	s.password.Destroy()
+	for _, root := range s.roots {
+		if root != nil {
+			root.Destroy()
+		}
+	}
+	if s.decoyKey != nil {
+		s.decoyKey.Destroy()
+	}
+}
+
+// keys derives the master key and root identifier for identifier under derivation i.
+func (s *Session) keys(i int, identifier *memguard.LockedBuffer) (*memguard.LockedBuffer, *memguard.LockedBuffer, error) {
+	d := s.derivations[i]
+	if !d.hierarchy {
+		return crypto.DeriveSecureValues(s.password, identifier, d.salt, d.kdf)
+	}
+
+	root, err := s.root(i)
+	if err != nil {
+		return nil, nil, err
+	}
+	return crypto.DeriveEntryValues(root, identifier)
+}
+
+// root returns the root secret for derivation i, deriving it the first time it is
+// needed.
+func (s *Session) root(i int) (*memguard.LockedBuffer, error) {
+	if s.roots[i] == nil {
+		d := s.derivations[i]
+		root, err := crypto.DeriveRootSecret(s.password, d.salt, d.kdf)
+		if err != nil {
+			return nil, err
+		}
+		s.roots[i] = root
+	}
+	return s.roots[i], nil
+}
+
+// decoys returns the key marking the decoys owned by the master password, deriving it
+// the first time it is needed.
+func (s *Session) decoys() (*memguard.LockedBuffer, error) {
+	if s.decoyKey == nil {
+		decoyKey, err := crypto.DeriveDecoyKey(s.password, s.vault.params.Salt, s.vault.decoyKDF)
+		if err != nil {
+			return nil, err
+		}
+		s.decoyKey = decoyKey
+	}
+	return s.decoyKey, nil
+}
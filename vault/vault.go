@@ -0,0 +1,859 @@
+// Package vault provides a programmatic interface to a dissident coffer. It wraps the
+// crypto and data packages so that programs can store and retrieve entries without
+// going through the interactive command line; nothing in it prints or exits.
+package vault
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"mime"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/awnumar/dissident/archive"
+	"github.com/awnumar/dissident/coffer"
+	"github.com/awnumar/dissident/crypto"
+	"github.com/awnumar/dissident/data"
+	"github.com/awnumar/memguard"
+)
+
+var (
+	// ErrNotDirectory is returned when extracting an entry that was not imported from a directory.
+	ErrNotDirectory = errors.New("! This entry is not a directory")
+
+	// ErrVaultExists is returned when creating a vault in a backend that already holds one.
+	ErrVaultExists = errors.New("! A vault already exists here")
+
+	// ErrNoVault is returned when opening a backend that holds nothing at all. New vaults
+	// are set up with Create.
+	ErrNoVault = errors.New("! There is no vault here; create one first")
+
+	// ErrVaultFull is returned when a constant-size vault doesn't have enough decoys
+	// owned by the master password to make room for an entry.
+	ErrVaultFull = errors.New("! Not enough decoys to make room; add more under this master password")
+)
+
+// Options configures a Vault.
+type Options struct {
+	// KDF is recorded in new vaults, and in vaults opened for the first time since
+	// KDFs were recorded, to derive every key with. Vaults that already record a KDF
+	// keep using theirs. If it is nil, crypto.DefaultKDF is used.
+	KDF crypto.KDF
+
+	// Hierarchy is recorded in new vaults to stretch the master password once per
+	// Session, rather than once per entry. Identifiers must then be secret, since
+	// nothing slows down guessing them.
+	Hierarchy bool
+
+	// Suite is recorded in new vaults to encrypt every chunk with. Vaults that
+	// already exist keep using theirs. If it is nil, crypto.DefaultSuite is used.
+	Suite crypto.Suite
+
+	// ChunkSize is recorded in new vaults as the size of every chunk, decoys included.
+	// Larger chunks mean fewer of them, but every entry takes up at least two. If it is
+	// zero, data.DefaultChunkSize is used.
+	ChunkSize int
+
+	// ConstantSize is recorded in new vaults to keep the number of values in them the
+	// same: importing evicts as many decoys as it adds chunks, and removing replaces
+	// every chunk with a decoy. Only decoys added through a Session can be evicted, and
+	// only by sessions with the same master password, since anything that could tell
+	// decoys apart without a password could be used to count the real chunks. Each
+	// session costs another stretching of the password. Vaults in a coffer.Fixed backend
+	// are always constant-size.
+	ConstantSize bool
+
+	// Buffers is how many chunks are encrypted or decrypted at once, and so how many
+	// are held in memory, while importing or exporting. It isn't recorded. If it is
+	// zero, data.DefaultBuffers is used.
+	Buffers int
+
+	// ReadOnly stops Open from recording anything in the vault, as it otherwise does in
+	// vaults that don't say which KDF they use, for backends opened only to inspect them.
+	ReadOnly bool
+}
+
+// Vault stores entries in a coffer.Backend.
+type Vault struct {
+	backend coffer.Backend
+	params  *coffer.Params
+	format  *data.Format
+
+	// The current derivation, followed by those in params.Previous.
+	derivations []derivation
+
+	// The KDF decoy keys are derived with, in constant-size vaults.
+	decoyKDF crypto.KDF
+}
+
+// derivation is a coffer.Derivation with its KDF parsed.
+type derivation struct {
+	salt      []byte
+	kdf       crypto.KDF
+	hierarchy bool
+}
+
+// Create sets up a new vault in backend, with a fresh random salt, and returns it as
+// Open does.
+func Create(backend coffer.Backend, opts *Options) (*Vault, error) {
+	params, err := coffer.LoadParams(backend)
+	if err != nil {
+		return nil, err
+	}
+	if params != nil {
+		return nil, ErrVaultExists
+	}
+
+	if err := data.CheckChunkSize(opts.chunkSize()); err != nil {
+		return nil, err
+	}
+
+	salt, err := crypto.GenerateRandomBytes(32)
+	if err != nil {
+		return nil, err
+	}
+	params = &coffer.Params{
+		Salt:      salt,
+		KDF:       opts.kdf().String(),
+		Hierarchy: opts != nil && opts.Hierarchy,
+		Suite:     opts.suite().String(),
+		ChunkSize: opts.chunkSize(),
+	}
+	if _, fixed := backend.(coffer.Fixed); fixed || opts != nil && opts.ConstantSize {
+		params.Decoys = params.KDF
+	}
+	if err := coffer.SaveParams(backend, params); err != nil {
+		return nil, err
+	}
+
+	return Open(backend, opts)
+}
+
+// Open returns a Vault that keeps its entries in backend. The backend is owned by the
+// vault from then on, and is closed along with it. If opts is nil the defaults are used.
+//
+// A backend with nothing in it holds no vault, and gives ErrNoVault. Vaults created
+// before salts were introduced are given one. Entries already stored in
+// them remain readable, and can be moved to the salted keys with Entry.Migrate. Until
+// then they are derived with the KDF chosen by opts, as they always were.
+func Open(backend coffer.Backend, opts *Options) (*Vault, error) {
+	params, err := coffer.LoadParams(backend)
+	if err != nil {
+		return nil, err
+	}
+	if params == nil {
+		empty, err := isEmpty(backend)
+		if err != nil {
+			return nil, err
+		}
+		if empty {
+			return nil, ErrNoVault
+		}
+
+		salt, err := crypto.GenerateRandomBytes(32)
+		if err != nil {
+			return nil, err
+		}
+		params = &coffer.Params{Salt: salt, Previous: []coffer.Derivation{{KDF: opts.kdf().String()}}}
+	}
+
+	// Record the KDF if the vault doesn't say which one it uses yet.
+	if params.KDF == "" {
+		params.KDF = opts.kdf().String()
+		if opts == nil || !opts.ReadOnly {
+			if err := coffer.SaveParams(backend, params); err != nil {
+				return nil, err
+			}
+		}
+	}
+	derivations, err := parseDerivations(params)
+	if err != nil {
+		return nil, err
+	}
+
+	// Vaults that don't say which suite they use have always used XSalsa20-Poly1305.
+	suite := crypto.XSalsa20Poly1305
+	if params.Suite != "" {
+		if suite, err = crypto.ParseSuite(params.Suite); err != nil {
+			return nil, err
+		}
+	}
+
+	// Those that don't say how big their chunks are have always used 4096 bytes.
+	chunkSize := data.DefaultChunkSize
+	if params.ChunkSize != 0 {
+		if chunkSize = params.ChunkSize; data.CheckChunkSize(chunkSize) != nil {
+			return nil, coffer.ErrInvalidParams
+		}
+	}
+	format := &data.Format{Suite: suite, ChunkSize: chunkSize}
+	if opts != nil {
+		format.Buffers = opts.Buffers
+	}
+
+	v := &Vault{backend: backend, params: params, format: format, derivations: derivations}
+	if params.Decoys != "" {
+		if v.decoyKDF, err = crypto.ParseKDF(params.Decoys); err != nil {
+			return nil, err
+		}
+	}
+
+	return v, nil
+}
+
+// isEmpty returns whether backend holds no values at all.
+func isEmpty(backend coffer.Backend) (bool, error) {
+	errFound := errors.New("! Found a value")
+	err := backend.Walk(func(identifier, ciphertext []byte) error {
+		return errFound
+	})
+	if err == errFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// parseDerivations parses the current and previous derivations in params.
+func parseDerivations(params *coffer.Params) ([]derivation, error) {
+	all := append([]coffer.Derivation{params.Current()}, params.Previous...)
+	derivations := make([]derivation, len(all))
+	for i, d := range all {
+		kdf, err := crypto.ParseKDF(d.KDF)
+		if err != nil {
+			return nil, err
+		}
+		derivations[i] = derivation{salt: d.Salt, kdf: kdf, hierarchy: d.Hierarchy}
+	}
+	return derivations, nil
+}
+
+// KDF returns the KDF that keys are derived with in this vault.
+func (v *Vault) KDF() crypto.KDF {
+	return v.derivations[0].kdf
+}
+
+// Suite returns the cipher suite that chunks are encrypted with in this vault.
+func (v *Vault) Suite() crypto.Suite {
+	return v.format.Suite
+}
+
+// ChunkSize returns the size of every chunk in this vault before it is encrypted.
+func (v *Vault) ChunkSize() int {
+	return v.format.ChunkSize
+}
+
+// ConstantSize reports whether this vault keeps the number of values in it the same.
+func (v *Vault) ConstantSize() bool {
+	return v.decoyKDF != nil
+}
+
+// Hierarchy reports whether keys are derived through a root secret in this vault.
+func (v *Vault) Hierarchy() bool {
+	return v.params.Hierarchy
+}
+
+// SetKDF changes the KDF that keys are derived with from now on. Entries that are already
+// stored are still found under the keys they were stored with, and can be moved over
+// with Entry.Migrate.
+func (v *Vault) SetKDF(kdf crypto.KDF) error {
+	d := v.params.Current()
+	d.KDF = kdf.String()
+	return v.setDerivation(d)
+}
+
+// SetHierarchy changes whether keys are derived through a root secret from now on.
+// Entries that are already stored are dealt with as they are by SetKDF.
+func (v *Vault) SetHierarchy(hierarchy bool) error {
+	d := v.params.Current()
+	d.Hierarchy = hierarchy
+	return v.setDerivation(d)
+}
+
+// setDerivation makes d the current derivation, if it isn't already.
+func (v *Vault) setDerivation(d coffer.Derivation) error {
+	current := v.params.Current()
+	if d.KDF == current.KDF && d.Hierarchy == current.Hierarchy {
+		return nil
+	}
+
+	// Remember the current derivation, and forget the new one if it was used before.
+	params := *v.params
+	params.KDF, params.Hierarchy = d.KDF, d.Hierarchy
+	params.Previous = []coffer.Derivation{current}
+	for _, p := range v.params.Previous {
+		if p.KDF != d.KDF || p.Hierarchy != d.Hierarchy || !bytes.Equal(p.Salt, d.Salt) {
+			params.Previous = append(params.Previous, p)
+		}
+	}
+	derivations, err := parseDerivations(&params)
+	if err != nil {
+		return err
+	}
+	if err := coffer.SaveParams(v.backend, &params); err != nil {
+		return err
+	}
+
+	v.params, v.derivations = &params, derivations
+	return nil
+}
+
+// kdf returns the KDF chosen by the options, or the default.
+func (opts *Options) kdf() crypto.KDF {
+	if opts == nil || opts.KDF == nil {
+		return crypto.DefaultKDF
+	}
+	return opts.KDF
+}
+
+// suite returns the cipher suite chosen by the options, or the default.
+func (opts *Options) suite() crypto.Suite {
+	if opts == nil || opts.Suite == nil {
+		return crypto.DefaultSuite
+	}
+	return opts.Suite
+}
+
+// chunkSize returns the chunk size chosen by the options, or the default.
+func (opts *Options) chunkSize() int {
+	if opts == nil || opts.ChunkSize == 0 {
+		return data.DefaultChunkSize
+	}
+	return opts.ChunkSize
+}
+
+// ValueSize returns the size of every value in a vault created with opts, for backends
+// that have to know it up front.
+func (opts *Options) ValueSize() int {
+	return opts.chunkSize() + opts.suite().Overhead()
+}
+
+// compact drops the values that have been deleted or overwritten from storage, for
+// backends that otherwise keep them until they get round to it.
+func (v *Vault) compact() error {
+	if c, ok := v.backend.(coffer.Compacter); ok {
+		return c.Compact()
+	}
+	return nil
+}
+
+// Close closes the underlying backend.
+func (v *Vault) Close() error {
+	return v.backend.Close()
+}
+
+// Entry derives the keys for the entry stored under password and identifier. The
+// derivation is expensive, so callers doing several things with one entry should
+// hold on to the returned handle and Destroy it when they are done, and callers
+// working with several entries should use a Session.
+func (v *Vault) Entry(password, identifier *memguard.LockedBuffer) (*Entry, error) {
+	s, err := v.Session(password)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Destroy()
+
+	return s.Entry(identifier)
+}
+
+// Put imports everything read from r as a new entry.
+func (v *Vault) Put(ctx context.Context, password, identifier *memguard.LockedBuffer, r io.Reader) error {
+	e, err := v.Entry(password, identifier)
+	if err != nil {
+		return err
+	}
+	defer e.Destroy()
+
+	return e.Put(ctx, r)
+}
+
+// Get writes the contents of an entry to w.
+func (v *Vault) Get(ctx context.Context, password, identifier *memguard.LockedBuffer, w io.Writer) error {
+	e, err := v.Entry(password, identifier)
+	if err != nil {
+		return err
+	}
+	defer e.Destroy()
+
+	return e.Get(ctx, w)
+}
+
+// Delete removes an entry.
+func (v *Vault) Delete(password, identifier *memguard.LockedBuffer) error {
+	e, err := v.Entry(password, identifier)
+	if err != nil {
+		return err
+	}
+	defer e.Destroy()
+
+	return e.Delete()
+}
+
+// Exists reports whether an entry is stored under password and identifier.
+func (v *Vault) Exists(password, identifier *memguard.LockedBuffer) (bool, error) {
+	e, err := v.Entry(password, identifier)
+	if err != nil {
+		return false, err
+	}
+	defer e.Destroy()
+
+	return e.Exists()
+}
+
+// AddDecoys adds n random decoys to the coffer. They are never evicted from
+// constant-size vaults; Session.AddDecoys adds ones that can be.
+func (v *Vault) AddDecoys(n int) error {
+	for i := 0; i < n; i++ {
+		// Generate the decoy.
+		identifier, ciphertext, err := crypto.GenDecoy(v.format.Suite, v.format.ChunkSize)
+		if err != nil {
+			return err
+		}
+
+		// Save it to the backend.
+		if err := v.backend.Save(identifier, ciphertext); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reclaiming runs fn while the decoys marked with decoyKey may be overwritten, if the
+// backend is a coffer.Fixed one.
+func (v *Vault) reclaiming(decoyKey *memguard.LockedBuffer, fn func() error) error {
+	fixed, ok := v.backend.(coffer.Fixed)
+	if !ok {
+		return fn()
+	}
+
+	fixed.Reclaim(func(identifier []byte) bool {
+		return crypto.IsOwnedDecoy(decoyKey, identifier)
+	})
+	defer fixed.Reclaim(nil)
+
+	return fn()
+}
+
+// addOwnedDecoys saves n decoys marked with decoyKey to s.
+func (v *Vault) addOwnedDecoys(s coffer.Store, decoyKey *memguard.LockedBuffer, n int) error {
+	for i := 0; i < n; i++ {
+		identifier, ciphertext, err := crypto.GenOwnedDecoy(v.format.Suite, v.format.ChunkSize, decoyKey)
+		if err != nil {
+			return err
+		}
+		if err := s.Save(identifier, ciphertext); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ownedDecoys returns the identifiers of every decoy marked with decoyKey. Nothing else
+// can be mistaken for one of them, so data stored under other passwords is safe.
+func (v *Vault) ownedDecoys(decoyKey *memguard.LockedBuffer) ([][]byte, error) {
+	var owned [][]byte
+	err := v.backend.Walk(func(identifier, _ []byte) error {
+		if crypto.IsOwnedDecoy(decoyKey, identifier) {
+			owned = append(owned, identifier)
+		}
+		return nil
+	})
+	return owned, err
+}
+
+// evictDecoys deletes n of the owned decoys from s, chosen at random. If there aren't
+// that many, none are deleted and ErrVaultFull is returned.
+func evictDecoys(s coffer.Store, owned [][]byte, n int) error {
+	if len(owned) < n {
+		return ErrVaultFull
+	}
+
+	// Shuffle the first n into place and delete them.
+	for i := 0; i < n; i++ {
+		j, err := rand.Int(rand.Reader, big.NewInt(int64(len(owned)-i)))
+		if err != nil {
+			return err
+		}
+		k := i + int(j.Int64())
+		owned[i], owned[k] = owned[k], owned[i]
+		if err := s.Delete(owned[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// balancedBackend is a backend whose transactions are passed to balance just before
+// they are committed, so that it can make more changes along with theirs.
+type balancedBackend struct {
+	coffer.Backend
+	balance func(tx coffer.Transaction) error
+}
+
+func (b *balancedBackend) Begin() (coffer.Transaction, error) {
+	tx, err := b.Backend.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &balancedTransaction{tx, b.balance}, nil
+}
+
+// balancedTransaction is a transaction begun on a balancedBackend.
+type balancedTransaction struct {
+	coffer.Transaction
+	balance func(tx coffer.Transaction) error
+}
+
+func (t *balancedTransaction) Commit() error {
+	if err := t.balance(t.Transaction); err != nil {
+		return err
+	}
+	return t.Transaction.Commit()
+}
+
+// Entry is a handle on the data stored under one password and identifier.
+type Entry struct {
+	vault          *Vault
+	masterKey      *memguard.LockedBuffer
+	rootIdentifier *memguard.LockedBuffer
+
+	// For entries stored under a previous salt or KDF, the current keys they move to
+	// when migrated.
+	currentKey  *memguard.LockedBuffer
+	currentRoot *memguard.LockedBuffer
+
+	// In constant-size vaults, the key marking the decoys this entry may evict.
+	decoyKey *memguard.LockedBuffer
+}
+
+// Exists reports whether anything is stored in this entry.
+func (e *Entry) Exists() (bool, error) {
+	return data.Exists(e.vault.backend, e.rootIdentifier)
+}
+
+// Length returns the length of the data stored in this entry.
+func (e *Entry) Length() (int64, error) {
+	exists, err := e.Exists()
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, data.ErrEntryNotFound
+	}
+
+	return data.MetaGetLength(e.vault.backend, e.vault.format, e.rootIdentifier, e.masterKey)
+}
+
+// Metadata returns the metadata stored with this entry.
+func (e *Entry) Metadata() (*data.Metadata, error) {
+	exists, err := e.Exists()
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, data.ErrEntryNotFound
+	}
+
+	return data.MetaGet(e.vault.backend, e.vault.format, e.rootIdentifier, e.masterKey)
+}
+
+// Put imports everything read from r into this entry, which must not already exist.
+// If ctx is cancelled the import is abandoned and the coffer is left untouched.
+func (e *Entry) Put(ctx context.Context, r io.Reader) error {
+	return e.balance(e.vault.chunksFor(0), func(db coffer.Backend) error {
+		return data.ImportData(db, e.vault.format, &contextReader{ctx, r}, nil, e.rootIdentifier, e.masterKey)
+	})
+}
+
+// PutFile is like Put, but also records the name, permissions and modification time
+// from info, which should describe the file that r reads from.
+func (e *Entry) PutFile(ctx context.Context, r io.Reader, info os.FileInfo) error {
+	meta := &data.Metadata{
+		Name:    info.Name(),
+		Mode:    info.Mode().Perm(),
+		ModTime: info.ModTime(),
+		MIME:    mime.TypeByExtension(filepath.Ext(info.Name())),
+	}
+	return e.balance(e.vault.chunksFor(info.Size()), func(db coffer.Backend) error {
+		return data.ImportData(db, e.vault.format, &contextReader{ctx, r}, meta, e.rootIdentifier, e.masterKey)
+	})
+}
+
+// PutDirectory imports the directory tree rooted at root into this entry, as a
+// single tar stream.
+func (e *Entry) PutDirectory(ctx context.Context, root string) error {
+	info, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(archive.Pack(pw, root))
+	}()
+	defer pr.Close()
+
+	meta := &data.Metadata{
+		Directory: true,
+		Name:      info.Name(),
+		Mode:      info.Mode().Perm(),
+		ModTime:   info.ModTime(),
+		MIME:      "application/x-tar",
+	}
+	return e.balance(e.vault.chunksFor(0), func(db coffer.Backend) error {
+		return data.ImportData(db, e.vault.format, &contextReader{ctx, pr}, meta, e.rootIdentifier, e.masterKey)
+	})
+}
+
+// Get writes the contents of this entry to w, stopping early if ctx is cancelled.
+// For a directory this is the tar stream it is stored as.
+func (e *Entry) Get(ctx context.Context, w io.Writer) error {
+	return data.ExportData(e.vault.backend, e.vault.format, &contextWriter{ctx, w}, e.rootIdentifier, e.masterKey)
+}
+
+// GetDirectory rebuilds the directory tree stored in this entry at dest, which must
+// not already exist.
+func (e *Entry) GetDirectory(ctx context.Context, dest string) error {
+	meta, err := e.Metadata()
+	if err != nil {
+		return err
+	}
+	if !meta.Directory {
+		return ErrNotDirectory
+	}
+
+	pr, pw := io.Pipe()
+	result := make(chan error, 1)
+	go func() {
+		err := e.Get(ctx, pw)
+		pw.CloseWithError(err)
+		result <- err
+	}()
+
+	// Drain whatever follows the end of the archive so that the export can finish.
+	err = archive.Unpack(pr, dest)
+	if err == nil {
+		_, err = io.Copy(ioutil.Discard, pr)
+	}
+	pr.CloseWithError(err)
+
+	if exportErr := <-result; exportErr != nil {
+		return exportErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return Restore(dest, meta)
+}
+
+// Reader returns a data.Reader for random access to this entry. It is only valid
+// until the Entry is destroyed.
+func (e *Entry) Reader() (*data.Reader, error) {
+	return data.NewReader(e.vault.backend, e.vault.format, e.rootIdentifier, e.masterKey)
+}
+
+// Verify decrypts every chunk of this entry without writing the plaintext anywhere, and
+// reports anything wrong with it.
+func (e *Entry) Verify() (*data.Verification, error) {
+	return data.VerifyData(e.vault.backend, e.vault.format, e.rootIdentifier, e.masterKey)
+}
+
+// Delete removes this entry.
+func (e *Entry) Delete() error {
+	return e.balance(0, e.remove)
+}
+
+// remove is Delete, making its changes through db.
+func (e *Entry) remove(db coffer.Backend) error {
+	if err := data.RemoveData(db, e.rootIdentifier); err != nil {
+		return err
+	}
+	return e.vault.compact()
+}
+
+// Version returns the protocol version this entry is stored under.
+func (e *Entry) Version() (int, error) {
+	exists, err := e.Exists()
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, data.ErrEntryNotFound
+	}
+
+	return data.EntryVersion(e.vault.backend, e.vault.format, e.rootIdentifier, e.masterKey)
+}
+
+// NeedsMigration reports whether this entry is stored under a previous salt or KDF of
+// the vault, or under an older protocol version.
+func (e *Entry) NeedsMigration() (bool, error) {
+	version, err := e.Version()
+	if err != nil {
+		return false, err
+	}
+
+	return e.currentKey != nil || version != data.Version2, nil
+}
+
+// Migrate re-encrypts this entry under the vault's current salt and KDF and the current
+// protocol version, if it isn't already stored that way. Old entries may gain a chunk;
+// if a constant-size vault has no decoy to evict for it, nothing is changed and
+// ErrVaultFull is returned.
+func (e *Entry) Migrate() error {
+	return e.balance(0, e.migrate)
+}
+
+// migrate is Migrate, making its changes through db.
+func (e *Entry) migrate(db coffer.Backend) error {
+	if e.currentKey == nil {
+		if err := data.MigrateData(db, e.vault.format, e.rootIdentifier, e.masterKey); err != nil {
+			return err
+		}
+		return e.vault.compact()
+	}
+
+	if err := data.RekeyData(db, e.vault.format, e.rootIdentifier, e.masterKey, e.currentRoot, e.currentKey); err != nil {
+		return err
+	}
+
+	// Carry on with the keys it has moved to.
+	e.masterKey.Destroy()
+	e.rootIdentifier.Destroy()
+	e.masterKey, e.rootIdentifier = e.currentKey, e.currentRoot
+	e.currentKey, e.currentRoot = nil, nil
+
+	return e.vault.compact()
+}
+
+// Destroy wipes the keys held by the handle. It must not be used afterwards.
+func (e *Entry) Destroy() {
+	e.masterKey.Destroy()
+	e.rootIdentifier.Destroy()
+	if e.currentKey != nil {
+		e.currentKey.Destroy()
+		e.currentRoot.Destroy()
+	}
+	if e.decoyKey != nil {
+		e.decoyKey.Destroy()
+	}
+}
+
+// balance runs op, which changes what is stored in this entry in a single transaction
+// begun on the backend it is given. In constant-size vaults that transaction also evicts
+// or adds decoys, so that the number of values in the vault is what it was, and all of
+// it is committed at once or not at all. adds is how many values op adds at least; if
+// there aren't that many decoys to evict, ErrVaultFull is returned before op is run, and
+// if there turn out to be too few once it has run, nothing is committed and ErrVaultFull
+// is returned.
+func (e *Entry) balance(adds int, op func(db coffer.Backend) error) error {
+	if e.decoyKey == nil {
+		return op(e.vault.backend)
+	}
+
+	return e.vault.reclaiming(e.decoyKey, func() error {
+		before, err := e.chunks(e.vault.backend)
+		if err != nil {
+			return err
+		}
+
+		// Fixed backends overwrite decoys to make room as they commit, or fail before
+		// writing anything.
+		_, fixed := e.vault.backend.(coffer.Fixed)
+		var owned [][]byte
+		if !fixed {
+			if owned, err = e.vault.ownedDecoys(e.decoyKey); err != nil {
+				return err
+			}
+			if len(owned) < adds {
+				return ErrVaultFull
+			}
+		}
+
+		db := &balancedBackend{e.vault.backend, func(tx coffer.Transaction) error {
+			after, err := e.chunks(tx)
+			switch {
+			case err != nil:
+				return err
+			case after < before:
+				return e.vault.addOwnedDecoys(tx, e.decoyKey, before-after)
+			case fixed:
+				return nil
+			default:
+				return evictDecoys(tx, owned, after-before)
+			}
+		}}
+		if err := op(db); err != coffer.ErrContainerFull {
+			return err
+		}
+		return ErrVaultFull
+	})
+}
+
+// chunks counts the values stored in s for this entry, under its current keys too if it
+// is waiting to move to them.
+func (e *Entry) chunks(s coffer.Store) (int, error) {
+	count, err := data.CountChunks(s, e.rootIdentifier)
+	if err != nil || e.currentRoot == nil {
+		return count, err
+	}
+	current, err := data.CountChunks(s, e.currentRoot)
+	return count + current, err
+}
+
+// chunksFor returns how many values an entry of size bytes takes up at least: its data
+// chunks, the last of which is never full, and a metadata chunk.
+func (v *Vault) chunksFor(size int64) int {
+	return int(size/int64(v.format.ChunkSize-1)) + 2
+}
+
+// Restore applies the permissions and modification time recorded in meta to the file
+// or directory at path. Attributes that weren't recorded are left alone.
+func Restore(path string, meta *data.Metadata) error {
+	if meta.Mode != 0 {
+		if err := os.Chmod(path, meta.Mode.Perm()); err != nil {
+			return err
+		}
+	}
+	if !meta.ModTime.IsZero() {
+		if err := os.Chtimes(path, time.Now(), meta.ModTime); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// contextReader fails reads once its context is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// contextWriter fails writes once its context is done.
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (c *contextWriter) Write(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.w.Write(p)
+}
@@ -0,0 +1,796 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/awnumar/dissident/coffer"
+	"github.com/awnumar/dissident/crypto"
+	"github.com/awnumar/dissident/data"
+	"github.com/awnumar/memguard"
+)
+
+// testKDF keeps key derivation fast in tests.
+var testKDF = crypto.Scrypt{LogN: 10, R: 8, P: 1}
+
+func secret(s string) *memguard.LockedBuffer {
+	b, _ := memguard.NewFromBytes([]byte(s), false)
+	return b
+}
+
+func TestVault(t *testing.T) {
+	backend := coffer.NewMemory()
+	v, err := Create(backend, &Options{KDF: testKDF})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	ctx := context.Background()
+	password, identifier := secret("password"), secret("identifier")
+	plaintext := bytes.Repeat([]byte("yellow submarine"), 1000)
+
+	if exists, err := v.Exists(password, identifier); err != nil || exists {
+		t.Error("Expected entry to not exist;", exists, err)
+	}
+
+	if err := v.Put(ctx, password, identifier, bytes.NewReader(plaintext)); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if exists, err := v.Exists(password, identifier); err != nil || !exists {
+		t.Error("Expected entry to exist;", exists, err)
+	}
+
+	var out bytes.Buffer
+	if err := v.Get(ctx, password, identifier, &out); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if !bytes.Equal(out.Bytes(), plaintext) {
+		t.Error("Retrieved data != stored data")
+	}
+
+	// A different password sees nothing.
+	if err := v.Get(ctx, secret("wrong"), identifier, &out); err != data.ErrEntryNotFound {
+		t.Error("Expected ErrEntryNotFound; got", err)
+	}
+
+	if err := v.Delete(password, identifier); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if backend.Len() != 1 {
+		t.Error("Expected only the vault parameters to be left; got", backend.Len())
+	}
+}
+
+func TestVaultCancel(t *testing.T) {
+	backend := coffer.NewMemory()
+	v, _ := Create(backend, &Options{KDF: testKDF})
+	defer v.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := v.Put(ctx, secret("password"), secret("identifier"), bytes.NewReader(make([]byte, 10000)))
+	if err != context.Canceled {
+		t.Error("Expected context.Canceled; got", err)
+	}
+	if backend.Len() != 1 {
+		t.Error("Cancelled import left", backend.Len()-1, "entries behind")
+	}
+}
+
+func TestAddDecoys(t *testing.T) {
+	backend := coffer.NewMemory()
+	v, _ := Create(backend, nil)
+	defer v.Close()
+
+	if err := v.AddDecoys(10); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if backend.Len() != 11 {
+		t.Error("Expected 10 decoys; got", backend.Len()-1)
+	}
+}
+
+func TestVaultDirectory(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "vault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	src := filepath.Join(tmp, "src")
+	os.MkdirAll(filepath.Join(src, "sub"), 0700)
+	ioutil.WriteFile(filepath.Join(src, "sub", "file"), []byte("yellow submarine"), 0600)
+	os.Chmod(src, 0750)
+
+	v, _ := Create(coffer.NewMemory(), &Options{KDF: testKDF})
+	defer v.Close()
+
+	ctx := context.Background()
+	entry, err := v.Entry(secret("password"), secret("identifier"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer entry.Destroy()
+
+	if err := entry.PutDirectory(ctx, src); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if meta, err := entry.Metadata(); err != nil || !meta.Directory {
+		t.Error("Expected directory metadata;", meta, err)
+	}
+
+	dest := filepath.Join(tmp, "dest")
+	if err := entry.GetDirectory(ctx, dest); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(dest, "sub", "file")); err != nil || string(b) != "yellow submarine" {
+		t.Error("Unexpected contents;", string(b), err)
+	}
+	if info, err := os.Stat(dest); err != nil || info.Mode().Perm() != 0750 {
+		t.Error("Expected root permissions to be restored;", err)
+	}
+
+	// Plain entries can't be extracted as directories.
+	other, _ := v.Entry(secret("password"), secret("other"))
+	defer other.Destroy()
+	other.Put(ctx, bytes.NewReader([]byte("not a directory")))
+	if err := other.GetDirectory(ctx, filepath.Join(tmp, "other")); err != ErrNotDirectory {
+		t.Error("Expected ErrNotDirectory; got", err)
+	}
+}
+
+func TestPutFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "vault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("yellow submarine")
+	f.Close()
+
+	modTime := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	os.Chmod(f.Name(), 0640)
+	os.Chtimes(f.Name(), modTime, modTime)
+	info, _ := os.Stat(f.Name())
+
+	v, _ := Create(coffer.NewMemory(), &Options{KDF: testKDF})
+	defer v.Close()
+	entry, _ := v.Entry(secret("password"), secret("identifier"))
+	defer entry.Destroy()
+
+	if err := entry.PutFile(context.Background(), strings.NewReader("yellow submarine"), info); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	meta, err := entry.Metadata()
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if meta.Name != info.Name() || meta.Mode != 0640 || !meta.ModTime.Equal(modTime) {
+		t.Errorf("Unexpected metadata: %+v", meta)
+	}
+
+	// Restoring puts the attributes back on a fresh copy.
+	out := f.Name() + ".out"
+	defer os.Remove(out)
+	ioutil.WriteFile(out, nil, 0600)
+	if err := Restore(out, meta); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if info, err := os.Stat(out); err != nil || info.Mode().Perm() != 0640 || !info.ModTime().Equal(modTime) {
+		t.Error("Attributes were not restored;", err)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	backend := coffer.NewMemory()
+	if _, err := Create(backend, nil); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	params, _ := coffer.LoadParams(backend)
+	if params == nil || len(params.Salt) != 32 || len(params.Previous) != 0 {
+		t.Errorf("Unexpected parameters: %+v", params)
+	}
+
+	if _, err := Create(backend, nil); err != ErrVaultExists {
+		t.Error("Expected ErrVaultExists; got", err)
+	}
+}
+
+func TestLegacyVault(t *testing.T) {
+	ctx := context.Background()
+	password, identifier := secret("password"), secret("identifier")
+	plaintext := []byte("yellow submarine")
+
+	// An empty backend holds no vault at all, legacy or otherwise.
+	backend := coffer.NewMemory()
+	if _, err := Open(backend, &Options{KDF: testKDF}); err != ErrNoVault {
+		t.Error("Expected ErrNoVault; got", err)
+	}
+	if params, _ := coffer.LoadParams(backend); params != nil {
+		t.Error("Opening an empty backend wrote to it")
+	}
+
+	// Store an entry the way vaults without a salt did.
+	masterKey, rootIdentifier, _ := crypto.DeriveSecureValues(password, identifier, nil, testKDF)
+	if err := data.ImportData(backend, nil, bytes.NewReader(plaintext), nil, rootIdentifier, masterKey); err != nil {
+		t.Fatal(err)
+	}
+
+	// Opening it only to inspect it records nothing.
+	v, err := Open(backend, &Options{KDF: testKDF, ReadOnly: true})
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if stats, err := v.Stats(); err != nil || stats.Values != 2 {
+		t.Error("Expected 2 values; got", stats, err)
+	}
+	if params, _ := coffer.LoadParams(backend); params != nil {
+		t.Error("Opening the vault read-only wrote to it")
+	}
+
+	v, err = Open(backend, &Options{KDF: testKDF})
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if params, _ := coffer.LoadParams(backend); params == nil || len(params.Previous) != 1 || params.Previous[0].Salt != nil {
+		t.Fatalf("Expected legacy parameters to be added: %+v", params)
+	}
+
+	// The old entry can still be read.
+	var out bytes.Buffer
+	if err := v.Get(ctx, password, identifier, &out); err != nil || !bytes.Equal(out.Bytes(), plaintext) {
+		t.Error("Failed to read unsalted entry:", err)
+	}
+
+	entry, _ := v.Entry(password, identifier)
+	if migrate, err := entry.NeedsMigration(); err != nil || !migrate {
+		t.Error("Expected unsalted entry to need migrating;", err)
+	}
+	if err := entry.Migrate(); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	entry.Destroy()
+
+	// Now it lives under the salted keys only.
+	if exists, _ := data.Exists(backend, rootIdentifier); exists {
+		t.Error("Unsalted entry was left behind")
+	}
+	entry, _ = v.Entry(password, identifier)
+	defer entry.Destroy()
+	if migrate, err := entry.NeedsMigration(); err != nil || migrate {
+		t.Error("Expected migrated entry to be current;", err)
+	}
+	out.Reset()
+	if err := entry.Get(ctx, &out); err != nil || !bytes.Equal(out.Bytes(), plaintext) {
+		t.Error("Failed to read migrated entry:", err)
+	}
+}
+
+func TestVaultKDF(t *testing.T) {
+	backend := coffer.NewMemory()
+	kdf := crypto.Argon2id{Time: 1, Memory: 64, Threads: 2}
+	v, err := Create(backend, &Options{KDF: kdf})
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	ctx := context.Background()
+	if err := v.Put(ctx, secret("password"), secret("identifier"), strings.NewReader("yellow submarine")); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	// Reopening keeps the KDF the vault was created with.
+	v, err = Open(backend, &Options{KDF: testKDF})
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if v.KDF() != kdf {
+		t.Error("Expected", kdf, "; got", v.KDF())
+	}
+	var out bytes.Buffer
+	if err := v.Get(ctx, secret("password"), secret("identifier"), &out); err != nil || out.String() != "yellow submarine" {
+		t.Error("Failed to read entry back:", err)
+	}
+}
+
+func TestSetKDF(t *testing.T) {
+	ctx := context.Background()
+	backend := coffer.NewMemory()
+	v, err := Create(backend, &Options{KDF: testKDF})
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if err := v.Put(ctx, secret("password"), secret("identifier"), strings.NewReader("yellow submarine")); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	kdf := crypto.Argon2id{Time: 1, Memory: 64, Threads: 2}
+	if err := v.SetKDF(kdf); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	// The change is recorded, and the entry is still found under the old keys.
+	v, err = Open(backend, nil)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if v.KDF() != kdf || len(v.params.Previous) != 1 || v.params.Previous[0].KDF != testKDF.String() {
+		t.Errorf("Unexpected parameters: %+v", v.params)
+	}
+	entry, err := v.Entry(secret("password"), secret("identifier"))
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	defer entry.Destroy()
+	if migrate, err := entry.NeedsMigration(); err != nil || !migrate {
+		t.Error("Expected entry to need migrating;", err)
+	}
+	if err := entry.Migrate(); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if migrate, err := entry.NeedsMigration(); err != nil || migrate {
+		t.Error("Expected migrated entry to be current;", err)
+	}
+	var out bytes.Buffer
+	if err := v.Get(ctx, secret("password"), secret("identifier"), &out); err != nil || out.String() != "yellow submarine" {
+		t.Error("Failed to read migrated entry:", err)
+	}
+
+	// Going back doesn't list the same derivation twice.
+	if err := v.SetKDF(testKDF); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if len(v.params.Previous) != 1 || v.params.Previous[0].KDF != kdf.String() {
+		t.Errorf("Unexpected parameters: %+v", v.params)
+	}
+}
+
+// countingKDF counts how many times keys are derived with it.
+type countingKDF struct {
+	crypto.KDF
+	calls *int
+}
+
+func (c countingKDF) Key(password, salt []byte, keyLen int) ([]byte, error) {
+	*c.calls++
+	return c.KDF.Key(password, salt, keyLen)
+}
+
+func TestSession(t *testing.T) {
+	ctx := context.Background()
+	backend := coffer.NewMemory()
+	v, err := Create(backend, &Options{KDF: testKDF, Hierarchy: true})
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if !v.Hierarchy() {
+		t.Fatal("Expected the vault to use the key hierarchy")
+	}
+	var calls int
+	v.derivations[0].kdf = countingKDF{testKDF, &calls}
+
+	// The password is only stretched once, however many entries are opened.
+	s, err := v.Session(secret("password"))
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	for _, id := range []string{"one", "two", "three"} {
+		e, err := s.Entry(secret(id))
+		if err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		if err := e.Put(ctx, strings.NewReader(id)); err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		e.Destroy()
+	}
+	s.Destroy()
+	if calls != 1 {
+		t.Error("Expected a single derivation; got", calls)
+	}
+
+	// The entries are where Vault.Entry looks for them, and apart from each other.
+	var out bytes.Buffer
+	if err := v.Get(ctx, secret("password"), secret("two"), &out); err != nil || out.String() != "two" {
+		t.Error("Failed to read entry back:", out.String(), err)
+	}
+	if exists, _ := v.Exists(secret("other password"), secret("two")); exists {
+		t.Error("Entry found under the wrong password")
+	}
+}
+
+func TestSetHierarchy(t *testing.T) {
+	ctx := context.Background()
+	backend := coffer.NewMemory()
+	v, err := Create(backend, &Options{KDF: testKDF})
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if err := v.Put(ctx, secret("password"), secret("identifier"), strings.NewReader("yellow submarine")); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	// Entries stored before switching are still found, and can be moved over.
+	if err := v.SetHierarchy(true); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if v, err = Open(backend, nil); err != nil || !v.Hierarchy() {
+		t.Fatal("Expected the key hierarchy to be recorded;", err)
+	}
+	entry, err := v.Entry(secret("password"), secret("identifier"))
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	defer entry.Destroy()
+	if migrate, err := entry.NeedsMigration(); err != nil || !migrate {
+		t.Error("Expected entry to need migrating;", err)
+	}
+	if err := entry.Migrate(); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	s, _ := v.Session(secret("password"))
+	defer s.Destroy()
+	e, err := s.Entry(secret("identifier"))
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	defer e.Destroy()
+	if migrate, err := e.NeedsMigration(); err != nil || migrate {
+		t.Error("Expected migrated entry to be current;", err)
+	}
+	var out bytes.Buffer
+	if err := e.Get(ctx, &out); err != nil || out.String() != "yellow submarine" {
+		t.Error("Failed to read migrated entry:", err)
+	}
+}
+
+func TestVaultSuite(t *testing.T) {
+	ctx := context.Background()
+	backend := coffer.NewMemory()
+	v, err := Create(backend, &Options{KDF: testKDF, Suite: crypto.AES256GCMSIV})
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if err := v.Put(ctx, secret("password"), secret("identifier"), strings.NewReader("yellow submarine")); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	// Reopening keeps the suite the vault was created with.
+	v, err = Open(backend, &Options{Suite: crypto.XChaCha20Poly1305})
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if v.Suite() != crypto.AES256GCMSIV {
+		t.Error("Expected", crypto.AES256GCMSIV, "; got", v.Suite())
+	}
+	var out bytes.Buffer
+	if err := v.Get(ctx, secret("password"), secret("identifier"), &out); err != nil || out.String() != "yellow submarine" {
+		t.Error("Failed to read entry back:", err)
+	}
+
+	// Decoys look like the chunks around them.
+	recorder := &saveRecorder{Backend: coffer.NewMemory()}
+	v, _ = Create(recorder, &Options{KDF: testKDF, Suite: crypto.AES256GCMSIV})
+	recorder.sizes = nil
+	if err := v.AddDecoys(1); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if len(recorder.sizes) != 1 || recorder.sizes[0] != 4096+crypto.AES256GCMSIV.Overhead() {
+		t.Error("Expected a decoy the size of a chunk; got", recorder.sizes)
+	}
+}
+
+func TestVaultChunkSize(t *testing.T) {
+	ctx := context.Background()
+	if _, err := Create(coffer.NewMemory(), &Options{KDF: testKDF, ChunkSize: 100}); err != data.ErrInvalidChunkSize {
+		t.Error("Expected ErrInvalidChunkSize; got", err)
+	}
+
+	recorder := &saveRecorder{Backend: coffer.NewMemory()}
+	v, err := Create(recorder, &Options{KDF: testKDF, ChunkSize: 64 << 10})
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	plaintext, _ := crypto.GenerateRandomBytes(200000)
+	if err := v.Put(ctx, secret("password"), secret("identifier"), bytes.NewReader(plaintext)); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	// Reopening keeps the chunk size the vault was created with.
+	v, err = Open(recorder, &Options{ChunkSize: 1 << 20})
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if v.ChunkSize() != 64<<10 {
+		t.Error("Expected 64 KiB chunks; got", v.ChunkSize())
+	}
+	var out bytes.Buffer
+	if err := v.Get(ctx, secret("password"), secret("identifier"), &out); err != nil || !bytes.Equal(out.Bytes(), plaintext) {
+		t.Error("Failed to read entry back:", err)
+	}
+
+	// Decoys are the same size as everything else.
+	recorder.sizes = nil
+	if err := v.AddDecoys(1); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if len(recorder.sizes) != 1 || recorder.sizes[0] != 64<<10+crypto.DefaultSuite.Overhead() {
+		t.Error("Expected a decoy the size of a chunk; got", recorder.sizes)
+	}
+}
+
+func TestConstantSize(t *testing.T) {
+	ctx := context.Background()
+	backend := coffer.NewMemory()
+	counter := &commitCounter{Backend: backend}
+	v, err := Create(counter, &Options{KDF: testKDF, ConstantSize: true})
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if !v.ConstantSize() {
+		t.Fatal("Expected a constant-size vault")
+	}
+
+	// Fill it with decoys under two passwords, and some that nobody owns.
+	a, _ := v.Session(secret("a"))
+	defer a.Destroy()
+	b, _ := v.Session(secret("b"))
+	defer b.Destroy()
+	if err := a.AddDecoys(10); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	b.AddDecoys(10)
+	v.AddDecoys(5)
+	size := backend.Len()
+	owned := func(s *Session) int {
+		key, _ := s.decoys()
+		var count int
+		backend.Walk(func(identifier, _ []byte) error {
+			if crypto.IsOwnedDecoy(key, identifier) {
+				count++
+			}
+			return nil
+		})
+		return count
+	}
+
+	// Importing swaps decoys owned by the same password for chunks.
+	e, err := a.Entry(secret("identifier"))
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	defer e.Destroy()
+	plaintext, _ := crypto.GenerateRandomBytes(10000)
+	counter.commits = 0
+	if err := e.Put(ctx, bytes.NewReader(plaintext)); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if backend.Len() != size || owned(a) != 6 || owned(b) != 10 {
+		t.Error("Expected 4 of a's decoys to be evicted; got", backend.Len(), owned(a), owned(b))
+	}
+	if counter.commits != 1 {
+		t.Error("Expected the chunks and the evictions to be committed together; got", counter.commits, "commits")
+	}
+
+	// Without enough decoys to cover even the smallest entry, nothing is read.
+	c, _ := v.Session(secret("c"))
+	defer c.Destroy()
+	empty, err := c.Entry(secret("identifier"))
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	defer empty.Destroy()
+	if err := empty.Put(ctx, unreadable{t}); err != ErrVaultFull {
+		t.Error("Expected ErrVaultFull; got", err)
+	}
+
+	// Entries that don't fit are taken out again.
+	large, err := a.Entry(secret("large"))
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	defer large.Destroy()
+	if err := large.Put(ctx, bytes.NewReader(make([]byte, 100000))); err != ErrVaultFull {
+		t.Error("Expected ErrVaultFull; got", err)
+	}
+	if exists, _ := large.Exists(); exists || backend.Len() != size || owned(a) != 6 {
+		t.Error("Expected a failed import to leave the vault as it was")
+	}
+
+	// Removing gives the room back.
+	counter.commits = 0
+	if err := e.Delete(); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if backend.Len() != size || owned(a) != 10 || owned(b) != 10 {
+		t.Error("Expected the chunks to be replaced with decoys; got", backend.Len(), owned(a), owned(b))
+	}
+	if counter.commits != 1 {
+		t.Error("Expected the removal and the decoys to be committed together; got", counter.commits, "commits")
+	}
+
+	// Reopening keeps the mode, even once the KDF has changed.
+	v.SetKDF(crypto.Scrypt{LogN: 11, R: 8, P: 1})
+	v, err = Open(backend, nil)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	a, _ = v.Session(secret("a"))
+	defer a.Destroy()
+	if !v.ConstantSize() || owned(a) != 10 {
+		t.Error("Expected decoys to still be owned after changing the KDF")
+	}
+}
+
+// commitCounter counts the transactions committed to a backend.
+type commitCounter struct {
+	coffer.Backend
+	commits int
+}
+
+func (c *commitCounter) Begin() (coffer.Transaction, error) {
+	tx, err := c.Backend.Begin()
+	return &countedTransaction{tx, c}, err
+}
+
+type countedTransaction struct {
+	coffer.Transaction
+	counter *commitCounter
+}
+
+func (t *countedTransaction) Commit() error {
+	t.counter.commits++
+	return t.Transaction.Commit()
+}
+
+// unreadable is a reader that fails the test if it is read.
+type unreadable struct {
+	t *testing.T
+}
+
+func (r unreadable) Read([]byte) (int, error) {
+	r.t.Error("Expected not to be read")
+	return 0, io.EOF
+}
+
+// saveRecorder records the size of everything saved straight to a backend.
+type saveRecorder struct {
+	coffer.Backend
+	sizes []int
+}
+
+func (s *saveRecorder) Save(identifier, ciphertext []byte) error {
+	s.sizes = append(s.sizes, len(ciphertext))
+	return s.Backend.Save(identifier, ciphertext)
+}
+
+func TestContainerVault(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dissident")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Room for 40 chunks.
+	ctx := context.Background()
+	path := filepath.Join(dir, "container")
+	opts := &Options{KDF: testKDF, ChunkSize: data.MinChunkSize}
+	backend, err := coffer.CreateContainer(path, 4096+40*(32+int64(opts.ValueSize())), opts.ValueSize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := Create(backend, opts)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if !v.ConstantSize() {
+		t.Fatal("Expected vaults in containers to be constant-size")
+	}
+
+	// Claim most of the room under one password.
+	s, _ := v.Session(secret("password"))
+	defer s.Destroy()
+	if err := s.AddDecoys(30); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	v.Close()
+
+	// Once reopened, only the decoys can make room for entries.
+	backend, err = coffer.OpenContainer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err = Open(backend, nil)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	defer v.Close()
+	s, _ = v.Session(secret("password"))
+	defer s.Destroy()
+
+	e, _ := s.Entry(secret("identifier"))
+	defer e.Destroy()
+	plaintext, _ := crypto.GenerateRandomBytes(10000)
+	if err := e.Put(ctx, bytes.NewReader(plaintext)); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	var exported bytes.Buffer
+	if err := e.Get(ctx, &exported); err != nil || !bytes.Equal(exported.Bytes(), plaintext) {
+		t.Error("Failed to export:", err)
+	}
+
+	large, _ := s.Entry(secret("large"))
+	defer large.Destroy()
+	if err := large.Put(ctx, bytes.NewReader(make([]byte, 30000))); err != ErrVaultFull {
+		t.Error("Expected ErrVaultFull; got", err)
+	}
+	if exists, _ := large.Exists(); exists {
+		t.Error("Expected a failed import to leave nothing behind")
+	}
+
+	// Removing an entry gives its room back to the password's decoys.
+	if err := e.Delete(); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if err := large.Put(ctx, bytes.NewReader(make([]byte, 20000))); err != nil {
+		t.Error("Expected the entry to fit once the other was removed; got", err)
+	}
+}
+
+func TestStatsAndCheck(t *testing.T) {
+	backend := coffer.NewMemory()
+	v, err := Create(backend, &Options{KDF: testKDF})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	// Three data chunks, one metadata chunk and two decoys.
+	plaintext, _ := crypto.GenerateRandomBytes(10000)
+	if err := v.Put(context.Background(), secret("password"), secret("identifier"), bytes.NewReader(plaintext)); err != nil {
+		t.Fatal(err)
+	}
+	v.AddDecoys(2)
+
+	stats, err := v.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Values != 6 || stats.Bytes != 6*4136 || len(stats.Sizes) != 1 || stats.Sizes[4136] != 6 || stats.ValueSize != 4136 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+	if err := v.Check(func(p Problem) { t.Error("Unexpected problem:", p.Err) }); err != nil {
+		t.Fatal(err)
+	}
+
+	// Values the vault couldn't have written are reported.
+	backend.Save([]byte("foreign"), make([]byte, 4136))
+	backend.Save(bytes.Repeat([]byte{1}, 32), make([]byte, 100))
+	backend.Save(bytes.Repeat([]byte{2}, 32), make([]byte, 5000))
+	found := make(map[error]int)
+	err = v.Check(func(p Problem) {
+		found[p.Err] = p.Size
+		if p.Err == ErrForeignIdentifier && p.Error() != "! Identifier is not 32 bytes; not written by this vault (666f726569676e, 4136 bytes)" {
+			t.Error("Unexpected message:", p)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 3 || found[ErrForeignIdentifier] != 4136 || found[ErrTruncatedValue] != 100 || found[ErrMalformedValue] != 5000 {
+		t.Error("Expected a foreign, a truncated and a malformed value; got", found)
+	}
+	if stats, _ := v.Stats(); stats.Values != 9 || len(stats.Sizes) != 3 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}